@@ -0,0 +1,132 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chronodium/storage/redis"
+	chronodiumTime "chronodium/util/time"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Writes a snapshot of the stored series to an archive file",
+	RunE:  runBackup,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restores the series from an archive file created by 'backup'",
+	Long: `Restores the series from an archive file created by 'backup'.
+
+A running daemon with a query cache may keep returning the previous
+contents of restored series for up to 5 minutes.`,
+	RunE: runRestore,
+}
+
+var backupOpts = struct {
+	File      string
+	Pattern   string
+	StartDate string
+	EndDate   string
+}{}
+
+func init() {
+	for _, cmd := range []*cobra.Command{backupCmd, restoreCmd} {
+		cmd.Flags().StringVarP(&backupOpts.File,
+			"file", "f", "", "The archive file, '-' for stdout or stdin")
+	}
+
+	backupCmd.Flags().StringVarP(&backupOpts.Pattern,
+		"pattern", "", "*", "Only backup metric keys matching this glob pattern")
+	backupCmd.Flags().StringVarP(&backupOpts.StartDate,
+		"start-date", "", "", "Only backup buckets containing points at or after this time (RFC3339 or unix timestamp)")
+	backupCmd.Flags().StringVarP(&backupOpts.EndDate,
+		"end-date", "", "", "Only backup buckets containing points at or before this time (RFC3339 or unix timestamp)")
+}
+
+func runBackup(_ *cobra.Command, args []string) error {
+	opts := &redis.BackupOptions{Pattern: backupOpts.Pattern}
+
+	var err error
+	if backupOpts.StartDate != "" {
+		if opts.StartDate, err = chronodiumTime.ParseTime(backupOpts.StartDate); err != nil {
+			return fmt.Errorf("Could not parse start-date: %s", err.Error())
+		}
+	}
+
+	if backupOpts.EndDate != "" {
+		if opts.EndDate, err = chronodiumTime.ParseTime(backupOpts.EndDate); err != nil {
+			return fmt.Errorf("Could not parse end-date: %s", err.Error())
+		}
+	}
+
+	repo, err := getRepo()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	switch backupOpts.File {
+	case "":
+		return fmt.Errorf("No archive file specified")
+	case "-":
+	default:
+		if out, err = os.Create(backupOpts.File); err != nil {
+			return fmt.Errorf("Could not create archive: %s", err.Error())
+		}
+	}
+
+	written, err := repo.Backup(out, opts)
+	if out != os.Stdout {
+		// Writes may only fail once the file is closed
+		if closeErr := out.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Could not write archive: %s", closeErr.Error())
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d keys\n", written)
+
+	return err
+}
+
+func runRestore(_ *cobra.Command, args []string) error {
+	repo, err := getRepo()
+	if err != nil {
+		return err
+	}
+
+	var in io.ReadCloser = os.Stdin
+	switch backupOpts.File {
+	case "":
+		return fmt.Errorf("No archive file specified")
+	case "-":
+	default:
+		if in, err = os.Open(backupOpts.File); err != nil {
+			return fmt.Errorf("Could not open archive: %s", err.Error())
+		}
+	}
+	defer in.Close()
+
+	restored, err := repo.Restore(in)
+	fmt.Fprintf(os.Stderr, "Restored %d keys\n", restored)
+
+	return err
+}
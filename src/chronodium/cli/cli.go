@@ -26,7 +26,12 @@ var RootCmd = &cobra.Command{
 
 func init() {
 	RootCmd.AddCommand(
+		backupCmd,
 		daemonCmd,
+		deleteCmd,
+		memoryCmd,
+		migrateCmd,
+		restoreCmd,
 
 		versionCmd,
 	)
@@ -26,6 +26,7 @@ import (
 	gcfg "gopkg.in/gcfg.v1"
 
 	"chronodium/server"
+	"chronodium/storage/redis"
 	"chronodium/util/stop"
 )
 
@@ -52,20 +53,18 @@ func init() {
 func runDaemon(_ *cobra.Command, args []string) error {
 	log.Printf("Starting Server")
 
-	config := server.NewConfig()
-	err := gcfg.ReadFileInto(config, daemonOpts.ConfFile)
+	config, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("Could not parse configuration: %s", err.Error())
-	}
-
-	if err = config.Validate(); err != nil {
-		return fmt.Errorf("Could not parse configuration: %s", err.Error())
+		return err
 	}
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt)
 	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGQUIT)
 
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+
 	stopper := stop.NewStopper()
 	s := server.NewServer(config, stopper)
 
@@ -73,14 +72,46 @@ func runDaemon(_ *cobra.Command, args []string) error {
 		return fmt.Errorf("chronodium could not start: %s", err)
 	}
 
-	select {
-	case <-stopper.ShouldStop():
-	case sig := <-signalCh:
-		log.Printf("received signal '%s'", sig)
-		s.Stop()
+	for running := true; running; {
+		select {
+		case <-stopper.ShouldStop():
+			running = false
+		case sig := <-signalCh:
+			log.Printf("received signal '%s'", sig)
+			s.Stop()
+			running = false
+		case <-reloadCh:
+			log.Printf("Reloading scripts")
+			s.Reload()
+		}
 	}
 
 	// TODO: Wait for stopper to complete
 
 	return nil
 }
+
+func loadConfig() (*server.Config, error) {
+	config := server.NewConfig()
+	err := gcfg.ReadFileInto(config, daemonOpts.ConfFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse configuration: %s", err.Error())
+	}
+
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("Could not parse configuration: %s", err.Error())
+	}
+
+	return config, nil
+}
+
+// getRepo returns a storage backend for commands that operate on the
+// stored data directly rather than through a running daemon.
+func getRepo() (*redis.Redis, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return redis.NewRedis(&config.Redis, stop.NewStopper(), config.TierSets), nil
+}
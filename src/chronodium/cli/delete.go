@@ -0,0 +1,89 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"chronodium/storage"
+	chronodiumTime "chronodium/util/time"
+)
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Deletes the points of a metric, optionally limited by filters and a time range",
+	Long: `Deletes the points of a metric, optionally limited by filters and a time range.
+
+A running daemon with a query cache may keep returning the deleted points
+for up to 5 minutes.`,
+	RunE: runDelete,
+}
+
+var deleteOpts = struct {
+	ShardKey  string
+	StartDate string
+	EndDate   string
+	Filter    []string
+}{}
+
+func init() {
+	deleteCmd.Flags().StringVarP(&deleteOpts.ShardKey,
+		"pk", "", "", "The primary key of the metric to delete")
+	deleteCmd.Flags().StringVarP(&deleteOpts.StartDate,
+		"start-date", "", "", "Only delete points at or after this time (RFC3339 or unix timestamp)")
+	deleteCmd.Flags().StringVarP(&deleteOpts.EndDate,
+		"end-date", "", "", "Only delete points at or before this time (RFC3339 or unix timestamp)")
+	deleteCmd.Flags().StringArrayVarP(&deleteOpts.Filter,
+		"filter", "", []string{}, "Only delete series with this metadata, in the form of key:value")
+}
+
+func runDelete(_ *cobra.Command, args []string) error {
+	query := &storage.Query{ShardKey: deleteOpts.ShardKey, Filter: make(map[string]string, 0)}
+	if query.ShardKey == "" {
+		return fmt.Errorf("No primary key specified")
+	}
+
+	var err error
+	if deleteOpts.StartDate != "" {
+		if query.StartDate, err = chronodiumTime.ParseTime(deleteOpts.StartDate); err != nil {
+			return fmt.Errorf("Could not parse start-date: %s", err.Error())
+		}
+	}
+
+	if deleteOpts.EndDate != "" {
+		if query.EndDate, err = chronodiumTime.ParseTime(deleteOpts.EndDate); err != nil {
+			return fmt.Errorf("Could not parse end-date: %s", err.Error())
+		}
+	}
+
+	for _, filterString := range deleteOpts.Filter {
+		if err := query.AddFilter(filterString); err != nil {
+			return err
+		}
+	}
+
+	repo, err := getRepo()
+	if err != nil {
+		return err
+	}
+
+	deleted, err := repo.Delete(query)
+	fmt.Printf("Deleted %d points\n", deleted)
+
+	return err
+}
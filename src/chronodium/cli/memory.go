@@ -0,0 +1,110 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"chronodium/storage"
+)
+
+var memoryCmd = &cobra.Command{
+	Use:   "memory",
+	Short: "Reports the memory used in Redis per metric key and tier set",
+	Long: `Reports the memory used in Redis per metric key and tier set.
+
+The memory used is extrapolated from a sample of the keys of every metric
+key. Scanning for keys stops after a minute.`,
+	RunE: runMemory,
+}
+
+var memoryOpts = struct {
+	Pattern string
+	Top     int
+}{}
+
+func init() {
+	memoryCmd.Flags().StringVarP(&memoryOpts.Pattern,
+		"pattern", "", "*", "Only report metric keys matching this glob pattern")
+	memoryCmd.Flags().IntVarP(&memoryOpts.Top,
+		"top", "", 25, "The number of metric keys to report, 0 for all")
+}
+
+func runMemory(_ *cobra.Command, args []string) error {
+	repo, err := getRepo()
+	if err != nil {
+		return err
+	}
+
+	report, err := repo.GetMemoryUsage(memoryOpts.Pattern)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TIER SET\tBYTES\tKEYS\tSERIES\t")
+	printMemoryUsage(w, report.TierSets, 0)
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", "(total)", report.Total.Bytes, report.Total.Keys, report.Total.Series)
+	fmt.Fprintln(w, "\t\t\t\t")
+	fmt.Fprintln(w, "METRIC\tBYTES\tKEYS\tSERIES\t")
+	printMemoryUsage(w, report.Metrics, memoryOpts.Top)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if report.Partial {
+		fmt.Fprintln(os.Stderr, "Scanning took too long, not all keys are included")
+	}
+	return nil
+}
+
+// printMemoryUsage prints the largest consumers first
+func printMemoryUsage(w *tabwriter.Writer, usages map[string]*storage.MemoryUsage, limit int) {
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Sort(byMemoryUsage{names, usages})
+
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	for _, name := range names {
+		usage := usages[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", name, usage.Bytes, usage.Keys, usage.Series)
+	}
+}
+
+type byMemoryUsage struct {
+	names  []string
+	usages map[string]*storage.MemoryUsage
+}
+
+func (s byMemoryUsage) Len() int {
+	return len(s.names)
+}
+func (s byMemoryUsage) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+func (s byMemoryUsage) Less(i, j int) bool {
+	return s.usages[s.names[i]].Bytes > s.usages[s.names[j]].Bytes
+}
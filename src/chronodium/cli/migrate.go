@@ -0,0 +1,50 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Converts the keys stored by a previous version to the current schema",
+	Long: `Converts the keys stored by a previous version to the current schema.
+
+Points written by an upgraded daemon before the migration are retained. Run
+it right after upgrading, as a running daemon only reads keys of the current
+schema, and may keep returning cached results for up to 5 minutes. Keys that
+cannot be converted are logged and skipped.`,
+	RunE: runMigrate,
+}
+
+func runMigrate(_ *cobra.Command, args []string) error {
+	repo, err := getRepo()
+	if err != nil {
+		return err
+	}
+
+	migrated, skipped, err := repo.Migrate()
+	fmt.Fprintf(os.Stderr, "Migrated %d keys, skipped %d keys\n", migrated, skipped)
+	if err == nil && skipped > 0 {
+		err = fmt.Errorf("Could not migrate %d keys, see the log for details", skipped)
+	}
+
+	return err
+}
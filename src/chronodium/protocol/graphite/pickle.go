@@ -0,0 +1,181 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The default port of carbon's pickle receiver
+const DEFAULT_PICKLE_PORT = 2004
+
+// The largest pickled message accepted, as in carbon
+const pickleMaxMessageSize = 1 << 20
+
+func (s *Server) startPickle() error {
+	port := s.config.PicklePort
+	if port == 0 {
+		port = DEFAULT_PICKLE_PORT
+	}
+
+	laddr, err := net.ResolveTCPAddr("tcp", s.config.Bind.String()+":"+strconv.Itoa(port))
+	if nil != err {
+		return err
+	}
+	listener, err := net.ListenTCP("tcp", laddr)
+	if nil != err {
+		return err
+	}
+	log.Printf("listening for pickles on %s", listener.Addr())
+
+	go s.serve(listener, s.handlePickleConn)
+	return nil
+}
+
+// handlePickleConn reads messages in carbon's pickle format, each being a
+// 4 byte big endian length followed by a pickled list of
+// (path, (timestamp, value)) tuples.
+func (s *Server) handlePickleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	rejections := newRejectionCounter(conn.RemoteAddr())
+	defer rejections.report()
+
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			log.Println("disconnecting because of application stop: ", conn.RemoteAddr())
+			return
+		default:
+		}
+		conn.SetDeadline(time.Now().Add(1e12))
+
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if length > pickleMaxMessageSize {
+			log.Printf("Disconnecting %s, sent a pickle of %d bytes", conn.RemoteAddr(), length)
+			return
+		}
+
+		message := make([]byte, length)
+		if _, err := io.ReadFull(reader, message); err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		if err := s.processPickle(message, rejections); err != nil {
+			rejections.add(err)
+		}
+	}
+}
+
+// processPickle stores all metrics in a message. Invalid metrics are
+// counted as rejections without affecting the others in the message, an
+// error is only returned if the message as a whole cannot be decoded.
+func (s *Server) processPickle(message []byte, rejections *rejectionCounter) error {
+	v, err := unpickle(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		return err
+	}
+
+	items, ok := v.(*pickleList)
+	if !ok {
+		return fmt.Errorf("Expected a list of metrics")
+	}
+
+	for _, item := range items.items {
+		m, err := s.parsePickledMetric(item)
+		if err != nil {
+			rejections.add(err)
+			continue
+		}
+
+		if m != nil {
+			s.storage <- m
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) parsePickledMetric(item interface{}) (*metric, error) {
+	tuple, ok := pickleItems(item)
+	if !ok || len(tuple) != 2 {
+		return nil, fmt.Errorf("Expected a (path, (timestamp, value)) tuple")
+	}
+	datapoint, ok := pickleItems(tuple[1])
+	if !ok || len(datapoint) != 2 {
+		return nil, fmt.Errorf("Expected a (path, (timestamp, value)) tuple")
+	}
+
+	path, ok := tuple[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Expected the path to be a string")
+	}
+	key, tags, err := s.parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := pickledNumber(datapoint[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timestamp for %s: %s", path, err.Error())
+	}
+	if math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return nil, fmt.Errorf("Invalid timestamp for %s: %v", path, ts)
+	}
+	value, err := pickledNumber(datapoint[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for %s: %s", path, err.Error())
+	}
+	if keep, err := s.config.acceptsValue(value); !keep {
+		return nil, err
+	}
+
+	return &metric{
+		key:      key,
+		value:    value,
+		ts:       floatToTime(ts),
+		metadata: tags,
+	}, nil
+}
+
+func pickledNumber(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case int64:
+		return float64(t), nil
+	case float64:
+		return t, nil
+	case string:
+		return strconv.ParseFloat(t, 64)
+	}
+
+	return 0, fmt.Errorf("Expected a number")
+}
@@ -17,23 +17,27 @@ package graphite
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
+
+	"chronodium/storage"
 )
 
 type metric struct {
-	key   string
-	value float64
-	ts    time.Time
+	key      string
+	value    float64
+	ts       time.Time
+	metadata map[string]string
 }
 
 func (m *metric) Key() string {
 	return m.key
 }
 
-func (m *metric) Value() float64 {
-	return m.value
+func (m *metric) Value() storage.Value {
+	return storage.FloatValue(m.value)
 }
 
 func (m *metric) Time() time.Time {
@@ -41,12 +45,19 @@ func (m *metric) Time() time.Time {
 }
 
 func (m *metric) Metadata() map[string]string {
-	return make(map[string]string, 0)
+	if m.metadata == nil {
+		return make(map[string]string, 0)
+	}
+	return m.metadata
+}
+
+func (m *metric) TierSet() string {
+	return ""
 }
 
 func (s *Server) processRawMetric(line string) error {
 	m, err := s.parseLine(line)
-	if err != nil {
+	if err != nil || m == nil {
 		return err
 	}
 
@@ -54,24 +65,109 @@ func (s *Server) processRawMetric(line string) error {
 	return nil
 }
 
+// parseLine parses a line in the form of '<path> <value> <timestamp>', any
+// whitespace may separate the fields. The timestamp is in (fractional)
+// seconds since the unix epoch, '-1' and 'N' mean now. Returns nil if the
+// metric is to be dropped silently.
 func (s *Server) parseLine(line string) (m *metric, err error) {
-	parts := strings.SplitN(line, " ", 4)
+	// The line ending does not count towards the length
+	if s.config.MaxLineLength > 0 && len(strings.TrimRight(line, "\r\n")) > s.config.MaxLineLength {
+		return nil, fmt.Errorf("Found a line exceeding the maximum length of %d bytes", s.config.MaxLineLength)
+	}
+
+	parts := strings.Fields(line)
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("Found %d parts, expected 3", len(parts))
 	}
 
-	m = &metric{
-		key: parts[0],
+	m = &metric{}
+	if m.key, m.metadata, err = s.parsePath(parts[0]); err != nil {
+		return nil, err
+	}
+	if m.value, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return nil, err
 	}
-	if m.value, err = strconv.ParseFloat(string(parts[1]), 64); err != nil {
+	if m.ts, err = parseTimestamp(parts[2]); err != nil {
 		return nil, err
 	}
 
-	i, err := strconv.ParseInt(strings.TrimSpace(string(parts[2])), 10, 64)
-	if err != nil {
+	if keep, err := s.config.acceptsValue(m.value); !keep {
 		return nil, err
 	}
-	m.ts = time.Unix(i, 0)
 
 	return m, nil
 }
+
+func parseTimestamp(timestamp string) (time.Time, error) {
+	if timestamp == "-1" || timestamp == "N" {
+		return time.Now(), nil
+	}
+
+	if i, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		return time.Unix(i, 0), nil
+	}
+
+	f, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("Invalid timestamp '%s'", timestamp)
+	}
+
+	return floatToTime(f), nil
+}
+
+// floatToTime converts fractional seconds since the unix epoch to a time,
+// without the loss of precision of multiplying them to nanoseconds first.
+func floatToTime(f float64) time.Time {
+	seconds, fraction := math.Modf(f)
+	return time.Unix(int64(seconds), int64(math.Floor(fraction*float64(time.Second)+0.5)))
+}
+
+// parsePath splits a path into the metric key and its tags, if any. Tagged
+// series as introduced by Graphite 1.1 are written as 'name;tag1=v1;tag2=v2'.
+// The templates are then applied to the name, tags extracted by the
+// templates do not override the explicit ones.
+func (s *Server) parsePath(path string) (key string, tags map[string]string, err error) {
+	parts := strings.Split(path, ";")
+	if parts[0] == "" {
+		return "", nil, fmt.Errorf("Found an empty metric name in '%s'", path)
+	}
+	if len(parts) == 1 {
+		key, tags = s.config.applyTemplates(path, nil)
+		return key, tags, nil
+	}
+
+	tags = make(map[string]string, len(parts)-1)
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("Found a tag without a value in '%s'", path)
+		}
+		if err := validateTag(kv[0], kv[1]); err != nil {
+			return "", nil, fmt.Errorf("%s in '%s'", err.Error(), path)
+		}
+		if _, exists := tags[kv[0]]; exists {
+			return "", nil, fmt.Errorf("Found tag '%s' more than once in '%s'", kv[0], path)
+		}
+
+		tags[kv[0]] = kv[1]
+	}
+
+	key, tags = s.config.applyTemplates(parts[0], tags)
+	return key, tags, nil
+}
+
+// validateTag checks a tag against the rules of Graphite: names must not be
+// empty or contain any of ';!^=', values must not be empty or start with '~'.
+func validateTag(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("Found a tag with an empty name")
+	}
+	if strings.ContainsAny(name, ";!^=") {
+		return fmt.Errorf("Found an invalid tag name '%s'", name)
+	}
+	if value == "" || value[0] == '~' {
+		return fmt.Errorf("Found an invalid value for tag '%s'", name)
+	}
+
+	return nil
+}
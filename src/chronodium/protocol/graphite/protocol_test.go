@@ -0,0 +1,83 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxLineLength(t *testing.T) {
+	s := &Server{config: &Config{MaxLineLength: 15}}
+
+	tests := []struct {
+		line  string
+		valid bool
+	}{
+		{"a.b.c 1 1500000\n", true},
+		{"a.b.c 1 1500000\r\n", true},
+		{"a.b.c 1 1500000", true},
+		{"a.b.cd 1 1500000\n", false},
+		{"a.b.cd 1 1500000\r\n", false},
+		{"a.b.c 1 1500000" + strings.Repeat(" ", 8192) + "\n", false},
+	}
+
+	for _, test := range tests {
+		line, err := s.readLine(bufio.NewReaderSize(strings.NewReader(test.line), 16))
+		if err != nil && line == "" {
+			t.Errorf("%q: unexpected error: %s", test.line, err.Error())
+			continue
+		}
+
+		_, err = s.parseLine(line)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", test.line, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("%q: expected the line to be rejected", test.line)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		expected  time.Time
+	}{
+		{"1500000000", time.Unix(1500000000, 0)},
+		{"1500000000.5", time.Unix(1500000000, 500000000)},
+		{"1500000000.25", time.Unix(1500000000, 250000000)},
+		{"1.0000000004", time.Unix(1, 0)},
+		{"1.0000000006", time.Unix(1, 1)},
+		{"-1.5", time.Unix(-2, 500000000)},
+	}
+
+	for _, test := range tests {
+		ts, err := parseTimestamp(test.timestamp)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.timestamp, err.Error())
+		} else if !ts.Equal(test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.timestamp, test.expected, ts)
+		}
+	}
+
+	for _, timestamp := range []string{"NaN", "Inf", "-Inf", "x"} {
+		if _, err := parseTimestamp(timestamp); err == nil {
+			t.Errorf("%s: expected the timestamp to be rejected", timestamp)
+		}
+	}
+}
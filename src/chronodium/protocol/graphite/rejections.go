@@ -0,0 +1,59 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const rejectionReportInterval = 1 * time.Minute
+
+// rejectionCounter counts the metrics rejected on a single connection, and
+// reports them at most once per interval rather than for every line.
+type rejectionCounter struct {
+	remoteAddr net.Addr
+	count      int
+	lastError  error
+	lastReport time.Time
+}
+
+func newRejectionCounter(remoteAddr net.Addr) *rejectionCounter {
+	return &rejectionCounter{
+		remoteAddr: remoteAddr,
+		lastReport: time.Now(),
+	}
+}
+
+func (r *rejectionCounter) add(err error) {
+	r.count++
+	r.lastError = err
+
+	if time.Since(r.lastReport) >= rejectionReportInterval {
+		r.report()
+	}
+}
+
+// report logs the rejections since the previous report, if any
+func (r *rejectionCounter) report() {
+	if r.count > 0 {
+		log.Printf("Rejected %d metrics from %s, last error: %s", r.count, r.remoteAddr, r.lastError.Error())
+	}
+
+	r.count = 0
+	r.lastReport = time.Now()
+}
@@ -17,8 +17,11 @@ package graphite
 
 import (
 	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"strconv"
 	"time"
@@ -31,12 +34,99 @@ type Config struct {
 	Enable bool
 	Port   int
 	Bind   net.IP
+
+	UdpEnable     bool `gcfg:"udp-enable"`
+	UdpPort       int  `gcfg:"udp-port"`        // Defaults to the TCP port
+	UdpReadBuffer int  `gcfg:"udp-read-buffer"` // Socket receive buffer in bytes, zero for the OS default
+
+	PickleEnable bool `gcfg:"pickle-enable"`
+	PicklePort   int  `gcfg:"pickle-port"` // Defaults to DEFAULT_PICKLE_PORT
+
+	// Templates to extract the key and metadata from dotted paths, the
+	// first template of which the filter matches is used.
+	Template          []string
+	TemplateSeparator string `gcfg:"template-separator"`
+
+	// Serve the TCP listeners over TLS, UDP must be disabled. When a client
+	// CA is given, clients must present a certificate signed by it.
+	TlsCert     string `gcfg:"tls-cert"`
+	TlsKey      string `gcfg:"tls-key"`
+	TlsClientCa string `gcfg:"tls-client-ca"`
+
+	// The maximum length of a line in bytes, zero for no limit
+	MaxLineLength int `gcfg:"max-line-length"`
+
+	// What to do with NaN and infinite values, see the NON_FINITE_* constants
+	NonFinite string `gcfg:"non-finite"`
+
+	templates []*template
+}
+
+const (
+	NON_FINITE_REJECT = "reject" // Count the line as invalid (default)
+	NON_FINITE_DROP   = "drop"   // Silently ignore the line
+	NON_FINITE_ACCEPT = "accept" // Store the value as is
+)
+
+func (c *Config) Validate() error {
+	if (c.TlsCert == "") != (c.TlsKey == "") {
+		return fmt.Errorf("Both tls-cert and tls-key must be given to enable TLS")
+	}
+	if c.TlsClientCa != "" && c.TlsCert == "" {
+		return fmt.Errorf("tls-client-ca requires tls-cert and tls-key to be given")
+	}
+	if c.TlsCert != "" && c.UdpEnable {
+		// UDP cannot be served over TLS, and would leave a plaintext way in
+		return fmt.Errorf("udp-enable cannot be combined with TLS")
+	}
+
+	switch c.NonFinite {
+	case "":
+		c.NonFinite = NON_FINITE_REJECT
+	case NON_FINITE_REJECT, NON_FINITE_DROP, NON_FINITE_ACCEPT:
+	default:
+		return fmt.Errorf("Unknown non-finite policy: %s", c.NonFinite)
+	}
+
+	if c.TemplateSeparator == "" {
+		c.TemplateSeparator = DEFAULT_TEMPLATE_SEPARATOR
+	}
+
+	c.templates = make([]*template, len(c.Template))
+	for i, definition := range c.Template {
+		var err error
+		if c.templates[i], err = parseTemplate(definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acceptsValue applies the non-finite policy to a value. Returns false if
+// the metric is not to be stored, with an error if it is to be rejected.
+func (c *Config) acceptsValue(value float64) (bool, error) {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return true, nil
+	}
+
+	switch c.NonFinite {
+	case NON_FINITE_ACCEPT:
+		return true, nil
+	case NON_FINITE_DROP:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Found a non-finite value %v", value)
 }
 
 type Server struct {
 	config  *Config
 	stopper *stop.Stopper
 	storage chan storage.Metric
+	tls     *tlsReloader
+
+	udpCounters udpCounters
 }
 
 func NewServer(config *Config, stopper *stop.Stopper) *Server {
@@ -48,6 +138,13 @@ func NewServer(config *Config, stopper *stop.Stopper) *Server {
 }
 
 func (s *Server) Start() error {
+	if s.config.TlsCert != "" {
+		var err error
+		if s.tls, err = newTlsReloader(s.config); err != nil {
+			return err
+		}
+	}
+
 	laddr, err := net.ResolveTCPAddr("tcp", s.config.Bind.String()+":"+strconv.Itoa(s.config.Port))
 	if nil != err {
 		return err
@@ -59,10 +156,24 @@ func (s *Server) Start() error {
 	log.Printf("listening on %s", listener.Addr())
 
 	go s.Serve(listener)
+
+	if s.config.UdpEnable {
+		if err := s.startUdp(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.PickleEnable {
+		return s.startPickle()
+	}
 	return nil
 }
 
 func (s *Server) Serve(listener *net.TCPListener) {
+	s.serve(listener, s.handleConn)
+}
+
+func (s *Server) serve(listener *net.TCPListener, handleConn func(net.Conn)) {
 	for {
 		select {
 		case <-s.stopper.ShouldStop():
@@ -81,13 +192,19 @@ func (s *Server) Serve(listener *net.TCPListener) {
 			continue
 		}
 		//		log.Println(conn.RemoteAddr(), "connected")
-		go s.handleConn(conn)
+		if s.tls != nil {
+			go handleConn(tls.Server(conn, s.tls.getConfig()))
+		} else {
+			go handleConn(conn)
+		}
 	}
 }
 
-func (s *Server) handleConn(conn *net.TCPConn) {
+func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
+	rejections := newRejectionCounter(conn.RemoteAddr())
+	defer rejections.report()
 
 	for {
 		select {
@@ -97,7 +214,7 @@ func (s *Server) handleConn(conn *net.TCPConn) {
 		default:
 		}
 		conn.SetDeadline(time.Now().Add(1e12))
-		message, err := reader.ReadString('\n')
+		message, err := s.readLine(reader)
 		if err == io.EOF {
 			return
 		} else if err != nil {
@@ -106,7 +223,28 @@ func (s *Server) handleConn(conn *net.TCPConn) {
 		}
 
 		if err := s.processRawMetric(message); err != nil {
-			log.Println(err.Error())
+			rejections.add(err)
+		}
+	}
+}
+
+// readLine reads up to and including the next newline. Lines exceeding
+// the maximum line length are truncated, so that they are rejected without
+// being read into memory entirely.
+func (s *Server) readLine(reader *bufio.Reader) (string, error) {
+	if s.config.MaxLineLength <= 0 {
+		return reader.ReadString('\n')
+	}
+
+	line := make([]byte, 0, 128)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line) <= s.config.MaxLineLength {
+			line = append(line, chunk...)
+		}
+
+		if err != bufio.ErrBufferFull {
+			return string(line), err
 		}
 	}
 }
@@ -0,0 +1,193 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const DEFAULT_TEMPLATE_SEPARATOR = "."
+
+// template extracts the key and metadata from a dotted path, in the same
+// format as the Graphite templates of InfluxDB:
+//
+//	[filter] template [tag1=value1,tag2=value2]
+//
+// The filter is a dotted pattern that must match the start of the path, with
+// '*' matching any segment. The template names the segments of the path:
+// 'measurement' segments make up the key, 'field' segments are stored as
+// _field, any other name stores the segment as tag of that name, and empty
+// names skip it. 'measurement*' and 'field*' consume all remaining segments.
+// The optional tags are stored on every metric the template applies to.
+type template struct {
+	filter      []string
+	parts       []string
+	defaultTags map[string]string
+}
+
+func parseTemplate(definition string) (*template, error) {
+	out := &template{defaultTags: make(map[string]string, 0)}
+
+	fields := strings.Fields(definition)
+	switch {
+	case len(fields) == 1:
+		out.parts = strings.Split(fields[0], ".")
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		out.parts = strings.Split(fields[0], ".")
+		if err := out.parseDefaultTags(fields[1]); err != nil {
+			return nil, err
+		}
+	case len(fields) == 2:
+		out.filter = strings.Split(fields[0], ".")
+		out.parts = strings.Split(fields[1], ".")
+	case len(fields) == 3:
+		out.filter = strings.Split(fields[0], ".")
+		out.parts = strings.Split(fields[1], ".")
+		if err := out.parseDefaultTags(fields[2]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Invalid template '%s'", definition)
+	}
+
+	for _, pattern := range out.filter {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid filter in template '%s'", definition)
+		}
+	}
+
+	hasMeasurement := false
+	for i, part := range out.parts {
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+		if strings.HasSuffix(part, "*") && i != len(out.parts)-1 {
+			return nil, fmt.Errorf("Only the last part of template '%s' may end with a '*'", definition)
+		}
+		if strings.HasSuffix(part, "*") && part != "measurement*" && part != "field*" {
+			return nil, fmt.Errorf("Invalid part '%s' in template '%s'", part, definition)
+		}
+		if part != "" && !strings.HasSuffix(part, "*") && part != "measurement" && part != "field" {
+			if err := validateTag(part, "-"); err != nil {
+				return nil, fmt.Errorf("%s in template '%s'", err.Error(), definition)
+			}
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("Template '%s' does not contain a measurement", definition)
+	}
+
+	return out, nil
+}
+
+func (t *template) parseDefaultTags(tags string) error {
+	for _, tag := range strings.Split(tags, ",") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Found a tag without a value in '%s'", tags)
+		}
+		if err := validateTag(kv[0], kv[1]); err != nil {
+			return err
+		}
+
+		t.defaultTags[kv[0]] = kv[1]
+	}
+
+	return nil
+}
+
+func (t *template) matches(segments []string) bool {
+	if len(t.filter) > len(segments) {
+		return false
+	}
+
+	for i, pattern := range t.filter {
+		if ok, _ := path.Match(pattern, segments[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply returns the key and tags extracted from the path. Tags are
+// only added to the given map if not present yet.
+func (t *template) apply(segments []string, separator string, tags map[string]string) string {
+	measurement := make([]string, 0)
+	field := make([]string, 0)
+	extracted := make(map[string][]string, 0)
+
+	for i, part := range t.parts {
+		if i >= len(segments) {
+			break
+		}
+
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, segments[i])
+		case "measurement*":
+			measurement = append(measurement, segments[i:]...)
+		case "field":
+			field = append(field, segments[i])
+		case "field*":
+			field = append(field, segments[i:]...)
+		default:
+			extracted[part] = append(extracted[part], segments[i])
+		}
+	}
+
+	for tag, values := range extracted {
+		if _, exists := tags[tag]; !exists {
+			tags[tag] = strings.Join(values, separator)
+		}
+	}
+	if _, exists := tags["_field"]; !exists && len(field) > 0 {
+		tags["_field"] = strings.Join(field, separator)
+	}
+	for tag, value := range t.defaultTags {
+		if _, exists := tags[tag]; !exists {
+			tags[tag] = value
+		}
+	}
+
+	if len(measurement) == 0 {
+		return strings.Join(segments, ".")
+	}
+	return strings.Join(measurement, separator)
+}
+
+// applyTemplates applies the first template that matches the name. Returns
+// the name as is if there is none.
+func (c *Config) applyTemplates(name string, tags map[string]string) (string, map[string]string) {
+	if len(c.templates) == 0 {
+		return name, tags
+	}
+
+	segments := strings.Split(name, ".")
+	for _, template := range c.templates {
+		if template.matches(segments) {
+			if tags == nil {
+				tags = make(map[string]string, 0)
+			}
+			return template.apply(segments, c.TemplateSeparator, tags), tags
+		}
+	}
+
+	return name, tags
+}
@@ -0,0 +1,88 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyTemplates(t *testing.T) {
+	config := &Config{
+		Template: []string{
+			"servers.* .host.measurement*",
+			"stats.*.counters measurement.host.field* type=counter",
+			"*.*.cpu region.host.measurement.field",
+			"app.* measurement.measurement..",
+		},
+		TemplateSeparator: "_",
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		key  string
+		out  map[string]string
+	}{
+		{"servers.web01.cpu.load", nil, "cpu_load", map[string]string{"host": "web01"}},
+		{"servers.web01", nil, "servers.web01", map[string]string{"host": "web01"}},
+		{"stats.web01.counters.requests.ok", nil, "stats", map[string]string{"host": "web01", "_field": "counters_requests_ok", "type": "counter"}},
+		{"stats.web01.counters", map[string]string{"type": "gauge"}, "stats", map[string]string{"host": "web01", "_field": "counters", "type": "gauge"}},
+		{"eu.web01.cpu.idle", nil, "cpu", map[string]string{"region": "eu", "host": "web01", "_field": "idle"}},
+		{"eu.web01.cpu.idle", map[string]string{"host": "override"}, "cpu", map[string]string{"region": "eu", "host": "override", "_field": "idle"}},
+		{"app.orders.ignored.too", nil, "app_orders", map[string]string{}},
+		{"other.metric", nil, "other.metric", nil},
+		{"other", map[string]string{"a": "b"}, "other", map[string]string{"a": "b"}},
+	}
+
+	for _, test := range tests {
+		key, tags := config.applyTemplates(test.name, test.tags)
+		if key != test.key {
+			t.Errorf("%s: expected key %s, got %s", test.name, test.key, key)
+		}
+		if !reflect.DeepEqual(tags, test.out) {
+			t.Errorf("%s: expected tags %v, got %v", test.name, test.out, tags)
+		}
+	}
+}
+
+func TestParseTemplateRejects(t *testing.T) {
+	tests := []struct {
+		definition string
+		err        string
+	}{
+		{"", "Invalid template ''"},
+		{"a b c d", "Invalid template 'a b c d'"},
+		{"host.field", "Template 'host.field' does not contain a measurement"},
+		{"measurement*.host", "Only the last part of template 'measurement*.host' may end with a '*'"},
+		{"measurement.host*", "Invalid part 'host*' in template 'measurement.host*'"},
+		{"a.[ measurement", "Invalid filter in template 'a.[ measurement'"},
+		{"measurement region", "Template 'measurement region' does not contain a measurement"},
+		{"measurement a=b,c", "Found a tag without a value in 'a=b,c'"},
+	}
+
+	for _, test := range tests {
+		_, err := parseTemplate(test.definition)
+		if err == nil {
+			t.Errorf("%s: expected error '%s', got none", test.definition, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%s: expected error '%s', got '%s'", test.definition, test.err, err.Error())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for modifications
+const tlsReloadInterval = 10 * time.Second
+
+// tlsReloader provides the TLS config for new connections, reloading the
+// certificate, key and client CA whenever any of their files is modified.
+type tlsReloader struct {
+	config *Config
+
+	lock      sync.Mutex
+	tls       *tls.Config
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newTlsReloader(config *Config) (*tlsReloader, error) {
+	r := &tlsReloader{config: config}
+
+	var err error
+	if r.modTime, err = r.getModTime(); err != nil {
+		return nil, err
+	}
+	if r.tls, err = r.load(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+
+	return r, nil
+}
+
+func (r *tlsReloader) getConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.lastCheck) < tlsReloadInterval {
+		return r.tls, nil
+	}
+	r.lastCheck = time.Now()
+
+	modTime, err := r.getModTime()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.tls, nil
+	}
+
+	config, err := r.load()
+	if err != nil {
+		// Files may be replaced one by one, try again on the next check
+		log.Printf("Could not reload TLS certificates, keeping the previous ones: %s", err.Error())
+		return r.tls, nil
+	}
+
+	log.Printf("Reloaded TLS certificates")
+	r.tls = config
+	r.modTime = modTime
+	return r.tls, nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.config.TlsCert, r.config.TlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load TLS certificate: %s", err.Error())
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.config.TlsClientCa != "" {
+		pem, err := ioutil.ReadFile(r.config.TlsClientCa)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load TLS client CA: %s", err.Error())
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Could not load TLS client CA: No certificates found in %s", r.config.TlsClientCa)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// getModTime returns the most recent modification time of the files
+func (r *tlsReloader) getModTime() (time.Time, error) {
+	var out time.Time
+	for _, path := range []string{r.config.TlsCert, r.config.TlsKey, r.config.TlsClientCa} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return out, err
+		}
+		if info.ModTime().After(out) {
+			out = info.ModTime()
+		}
+	}
+
+	return out, nil
+}
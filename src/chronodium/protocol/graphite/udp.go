@@ -0,0 +1,130 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The maximum size of a UDP datagram
+const udpDatagramSize = 65536
+
+const udpReportInterval = 1 * time.Minute
+
+// udpCounters keeps track of the lines received over UDP that could not be
+// processed. Fire-and-forget senders never learn about these, so they are
+// reported periodically.
+type udpCounters struct {
+	invalid uint64 // Lines that could not be parsed
+	dropped uint64 // Metrics dropped because the storage did not keep up
+}
+
+func (s *Server) startUdp() error {
+	port := s.config.UdpPort
+	if port == 0 {
+		port = s.config.Port
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", s.config.Bind.String()+":"+strconv.Itoa(port))
+	if nil != err {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if nil != err {
+		return err
+	}
+
+	if s.config.UdpReadBuffer > 0 {
+		if err := conn.SetReadBuffer(s.config.UdpReadBuffer); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	log.Printf("listening on udp %s", conn.LocalAddr())
+
+	go s.ServeUdp(conn)
+	go s.reportUdpCounters()
+	return nil
+}
+
+func (s *Server) ServeUdp(conn *net.UDPConn) {
+	defer conn.Close()
+	buf := make([]byte, udpDatagramSize)
+
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			log.Println("stopping listening on", conn.LocalAddr())
+			return
+		default:
+		}
+
+		conn.SetReadDeadline(time.Now().Add(1e9))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			log.Println(err)
+			continue
+		}
+
+		s.processDatagram(buf[:n])
+	}
+}
+
+// processDatagram processes all newline separated metrics in a datagram.
+// Rather than blocking the socket when the storage does not keep up (in
+// which case the kernel would drop datagrams without us knowing), metrics
+// are dropped and counted.
+func (s *Server) processDatagram(datagram []byte) {
+	for _, line := range bytes.Split(datagram, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		m, err := s.parseLine(string(line))
+		if err != nil {
+			atomic.AddUint64(&s.udpCounters.invalid, 1)
+			continue
+		} else if m == nil {
+			continue
+		}
+
+		select {
+		case s.storage <- m:
+		default:
+			atomic.AddUint64(&s.udpCounters.dropped, 1)
+		}
+	}
+}
+
+func (s *Server) reportUdpCounters() {
+	ticker := time.NewTicker(udpReportInterval)
+	for range ticker.C {
+		if invalid := atomic.SwapUint64(&s.udpCounters.invalid, 0); invalid > 0 {
+			log.Printf("Ignored %d invalid lines received over UDP", invalid)
+		}
+		if dropped := atomic.SwapUint64(&s.udpCounters.dropped, 0); dropped > 0 {
+			log.Printf("Dropped %d metrics received over UDP because the storage did not keep up", dropped)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Pickle opcodes. Only those needed to decode lists of tuples of strings and
+// numbers are supported, all others (most notably those that instantiate
+// objects or call functions) are rejected.
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opNone            = 'N'
+	opInt             = 'I'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opLong            = 'L'
+	opFloat           = 'F'
+	opBinFloat        = 'G'
+	opString          = 'S'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opUnicode         = 'V'
+	opBinUnicode      = 'X'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opEmptyList       = ']'
+	opAppend          = 'a'
+	opAppends         = 'e'
+	opList            = 'l'
+	opEmptyTuple      = ')'
+	opTuple           = 't'
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opProto           = 0x80
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opNewTrue         = 0x88
+	opNewFalse        = 0x89
+	opLong1           = 0x8a
+	opShortBinUnicode = 0x8c
+	opBinUnicode8     = 0x8d
+	opMemoize         = 0x94
+	opFrame           = 0x95
+)
+
+// The largest string a pickle may contain, guards against allocating
+// arbitrary amounts of memory for a malicious length prefix.
+const pickleMaxString = 1 << 20
+
+// The deepest nesting of lists and tuples a pickle may contain
+const pickleMaxDepth = 8
+
+// The number of list and tuple elements a pickle may contain in total.
+// Memoized values are shared rather than copied, but a pickle may still
+// reference them over and over again.
+const pickleMaxElements = 1 << 18
+
+// pickleList is a list, which unlike a tuple can be appended to after it
+// has been memoized. Once a list is an element of another list or tuple it
+// is frozen, so no list can ever end up containing itself.
+type pickleList struct {
+	items  []interface{}
+	depth  int
+	frozen bool
+}
+
+type pickleTuple struct {
+	items []interface{}
+	depth int
+}
+
+// pickleItems returns the elements of a list or tuple
+func pickleItems(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case *pickleList:
+		return t.items, true
+	case *pickleTuple:
+		return t.items, true
+	}
+
+	return nil, false
+}
+
+type mark struct{}
+
+// unpickle decodes a pickle holding (nested) lists and tuples of strings and
+// numbers. Strings are returned as string, integers as int64, floats as
+// float64, lists as *pickleList and tuples as *pickleTuple. Use pickleItems
+// to get at the elements of either.
+func unpickle(rd *bufio.Reader) (interface{}, error) {
+	stack := make([]interface{}, 0, 16)
+	memo := make(map[int]interface{}, 0)
+	elements := 0
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("Pickle stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(mark); ok {
+				items := append([]interface{}{}, stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, fmt.Errorf("Pickle mark not found")
+	}
+	top := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("Pickle stack underflow")
+		}
+		return stack[len(stack)-1], nil
+	}
+	// contain accounts for items being added to a list or tuple, and returns
+	// the depth of a container holding them
+	contain := func(items []interface{}) (int, error) {
+		elements += len(items)
+		if elements > pickleMaxElements {
+			return 0, fmt.Errorf("Pickle contains more than %d elements", pickleMaxElements)
+		}
+
+		depth := 0
+		for _, item := range items {
+			switch t := item.(type) {
+			case *pickleList:
+				t.frozen = true
+				if t.depth > depth {
+					depth = t.depth
+				}
+			case *pickleTuple:
+				if t.depth > depth {
+					depth = t.depth
+				}
+			}
+		}
+		if depth+1 > pickleMaxDepth {
+			return 0, fmt.Errorf("Pickle is nested more than %d levels deep", pickleMaxDepth)
+		}
+		return depth + 1, nil
+	}
+
+	for {
+		op, err := rd.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opStop:
+			v, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			return v, nil
+
+		case opProto:
+			if _, err := rd.ReadByte(); err != nil {
+				return nil, err
+			}
+
+		case opFrame:
+			if _, err := rd.Discard(8); err != nil {
+				return nil, err
+			}
+
+		case opMark:
+			stack = append(stack, mark{})
+
+		case opPop:
+			if _, err := pop(); err != nil {
+				return nil, err
+			}
+
+		case opNone:
+			stack = append(stack, nil)
+
+		case opNewTrue:
+			stack = append(stack, int64(1))
+
+		case opNewFalse:
+			stack = append(stack, int64(0))
+
+		case opInt, opLong:
+			line, err := readPickleLine(rd)
+			if err != nil {
+				return nil, err
+			}
+			i, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid integer in pickle: %s", line)
+			}
+			stack = append(stack, i)
+
+		case opBinInt:
+			buf, err := readPickleBytes(rd, 4)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(int32(binary.LittleEndian.Uint32(buf))))
+
+		case opBinInt1:
+			b, err := rd.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(b))
+
+		case opBinInt2:
+			buf, err := readPickleBytes(rd, 2)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(binary.LittleEndian.Uint16(buf)))
+
+		case opLong1:
+			n, err := rd.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			buf, err := readPickleBytes(rd, int(n))
+			if err != nil {
+				return nil, err
+			}
+			i, err := decodePickleLong(buf)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, i)
+
+		case opFloat:
+			line, err := readPickleLine(rd)
+			if err != nil {
+				return nil, err
+			}
+			f, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid float in pickle: %s", line)
+			}
+			stack = append(stack, f)
+
+		case opBinFloat:
+			buf, err := readPickleBytes(rd, 8)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(buf)))
+
+		case opString:
+			line, err := readPickleLine(rd)
+			if err != nil {
+				return nil, err
+			}
+			s, err := unquotePickleString(line)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, s)
+
+		case opUnicode:
+			line, err := readPickleLine(rd)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, line)
+
+		case opShortBinString, opShortBinBytes, opShortBinUnicode:
+			n, err := rd.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			buf, err := readPickleBytes(rd, int(n))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(buf))
+
+		case opBinString, opBinBytes, opBinUnicode:
+			buf, err := readPickleBytes(rd, 4)
+			if err != nil {
+				return nil, err
+			}
+			if buf, err = readPickleBytes(rd, int(binary.LittleEndian.Uint32(buf))); err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(buf))
+
+		case opBinUnicode8:
+			buf, err := readPickleBytes(rd, 8)
+			if err != nil {
+				return nil, err
+			}
+			length := binary.LittleEndian.Uint64(buf)
+			if length > pickleMaxString {
+				return nil, fmt.Errorf("Pickle contains a string of %d bytes", length)
+			}
+			if buf, err = readPickleBytes(rd, int(length)); err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(buf))
+
+		case opEmptyList:
+			stack = append(stack, &pickleList{depth: 1})
+
+		case opList:
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			depth, err := contain(items)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, &pickleList{items: items, depth: depth})
+
+		case opAppend, opAppends:
+			var items []interface{}
+			if op == opAppend {
+				v, err := pop()
+				if err != nil {
+					return nil, err
+				}
+				items = []interface{}{v}
+			} else if items, err = popMark(); err != nil {
+				return nil, err
+			}
+
+			v, err := top()
+			if err != nil {
+				return nil, err
+			}
+			list, ok := v.(*pickleList)
+			if !ok {
+				return nil, fmt.Errorf("Pickle appends to a non-list")
+			}
+			if list.frozen {
+				return nil, fmt.Errorf("Pickle appends to a list that is already contained by another")
+			}
+			for _, item := range items {
+				if item == v {
+					return nil, fmt.Errorf("Pickle appends a list to itself")
+				}
+			}
+
+			depth, err := contain(items)
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, items...)
+			if depth > list.depth {
+				list.depth = depth
+			}
+
+		case opEmptyTuple:
+			stack = append(stack, &pickleTuple{depth: 1})
+
+		case opTuple:
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			depth, err := contain(items)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, &pickleTuple{items, depth})
+
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(stack) < n {
+				return nil, fmt.Errorf("Pickle stack underflow")
+			}
+			items := append([]interface{}{}, stack[len(stack)-n:]...)
+			depth, err := contain(items)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack[:len(stack)-n], &pickleTuple{items, depth})
+
+		case opPut, opBinPut, opLongBinPut, opMemoize:
+			var idx int
+			switch op {
+			case opPut:
+				line, err := readPickleLine(rd)
+				if err != nil {
+					return nil, err
+				}
+				if idx, err = strconv.Atoi(line); err != nil {
+					return nil, fmt.Errorf("Invalid memo index in pickle: %s", line)
+				}
+			case opBinPut:
+				b, err := rd.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				idx = int(b)
+			case opLongBinPut:
+				buf, err := readPickleBytes(rd, 4)
+				if err != nil {
+					return nil, err
+				}
+				idx = int(binary.LittleEndian.Uint32(buf))
+			case opMemoize:
+				idx = len(memo)
+			}
+
+			v, err := top()
+			if err != nil {
+				return nil, err
+			}
+			memo[idx] = v
+
+		case opGet, opBinGet, opLongBinGet:
+			var idx int
+			switch op {
+			case opGet:
+				line, err := readPickleLine(rd)
+				if err != nil {
+					return nil, err
+				}
+				if idx, err = strconv.Atoi(line); err != nil {
+					return nil, fmt.Errorf("Invalid memo index in pickle: %s", line)
+				}
+			case opBinGet:
+				b, err := rd.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				idx = int(b)
+			case opLongBinGet:
+				buf, err := readPickleBytes(rd, 4)
+				if err != nil {
+					return nil, err
+				}
+				idx = int(binary.LittleEndian.Uint32(buf))
+			}
+
+			v, ok := memo[idx]
+			if !ok {
+				return nil, fmt.Errorf("Pickle references unknown memo index %d", idx)
+			}
+			stack = append(stack, v)
+
+		default:
+			return nil, fmt.Errorf("Pickle contains unsupported opcode 0x%02x", op)
+		}
+	}
+}
+
+func readPickleLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > pickleMaxString {
+		return "", fmt.Errorf("Pickle contains a line of %d bytes", len(line))
+	}
+
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func readPickleBytes(rd io.Reader, length int) ([]byte, error) {
+	if length < 0 || length > pickleMaxString {
+		return nil, fmt.Errorf("Pickle contains a string of %d bytes", length)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// decodePickleLong decodes a little endian two's complement integer
+func decodePickleLong(buf []byte) (int64, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+
+	be := make([]byte, len(buf))
+	for i, b := range buf {
+		be[len(buf)-1-i] = b
+	}
+
+	i := new(big.Int).SetBytes(be)
+	if buf[len(buf)-1]&0x80 != 0 {
+		i.Sub(i, new(big.Int).Lsh(big.NewInt(1), uint(8*len(buf))))
+	}
+	if !i.IsInt64() {
+		return 0, fmt.Errorf("Pickle contains an integer that does not fit 64 bits")
+	}
+
+	return i.Int64(), nil
+}
+
+// unquotePickleString decodes a Python string literal as written by repr()
+func unquotePickleString(line string) (string, error) {
+	if len(line) < 2 || (line[0] != '\'' && line[0] != '"') || line[len(line)-1] != line[0] {
+		return "", fmt.Errorf("Invalid string in pickle: %s", line)
+	}
+
+	quote := line[0]
+	s := line[1 : len(line)-1]
+	out := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		r, _, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return "", fmt.Errorf("Invalid string in pickle: %s", line)
+		}
+
+		out = append(out, []byte(string(r))...)
+		s = tail
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,144 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package graphite
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chronodium/storage"
+)
+
+// The list [('a.b.c', (1500000000, 1.5)), ('x;tag=v', (1500000001.25, -2))]
+// as pickled by Python in several protocol versions
+var pickledMetrics = map[string]string{
+	"protocol 0": "(lp0\n(Va.b.c\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vx;tag=v\np4\n(F1500000001.25\nI-2\ntp5\ntp6\na.",
+	"protocol 1": "]q\x00((X\x05\x00\x00\x00a.b.cq\x01(J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00tq\x02tq\x03(X\x07\x00\x00\x00x;tag=vq\x04(GA\xd6Z\x0b\xc0P\x00\x00J\xfe\xff\xff\xfftq\x05tq\x06e.",
+	"protocol 2": "\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x07\x00\x00\x00x;tag=vq\x04GA\xd6Z\x0b\xc0P\x00\x00J\xfe\xff\xff\xff\x86q\x05\x86q\x06e.",
+	"protocol 4": "\x80\x04\x95;\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x05a.b.c\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x07x;tag=v\x94GA\xd6Z\x0b\xc0P\x00\x00J\xfe\xff\xff\xff\x86\x94\x86\x94e.",
+}
+
+// plainPickle replaces all lists and tuples by slices so results can be
+// compared
+func plainPickle(v interface{}) interface{} {
+	items, ok := pickleItems(v)
+	if !ok {
+		return v
+	}
+
+	out := make([]interface{}, len(items))
+	for i, item := range items {
+		out[i] = plainPickle(item)
+	}
+	return out
+}
+
+func TestUnpickle(t *testing.T) {
+	expected := []interface{}{
+		[]interface{}{"a.b.c", []interface{}{int64(1500000000), 1.5}},
+		[]interface{}{"x;tag=v", []interface{}{1500000001.25, int64(-2)}},
+	}
+
+	for name, pickled := range pickledMetrics {
+		v, err := unpickle(bufio.NewReader(strings.NewReader(pickled)))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+			continue
+		}
+		if actual := plainPickle(v); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %#v, got %#v", name, expected, actual)
+		}
+	}
+}
+
+// memoDoubling returns a pickle of a tuple holding the previous tuple twice,
+// repeated n times. Fully expanded it would hold 2^n elements.
+func memoDoubling(n int) string {
+	pickled := "\x80\x02K\x01q\x00"
+	for i := 0; i < n; i++ {
+		pickled += "h\x00h\x00\x86q\x00"
+	}
+	return pickled + "."
+}
+
+func TestUnpickleRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		pickled string
+		err     string
+	}{
+		{"list containing itself", "\x80\x02]q\x00h\x00a.", "Pickle appends a list to itself"},
+		{"list appended to a contained list", "\x80\x02]q\x00h\x00\x85h\x00K\x01a.", "Pickle appends to a list that is already contained by another"},
+		{"list appended to its own element", "\x80\x02]q\x00]q\x01h\x00aa.", "Pickle appends to a list that is already contained by another"},
+		{"memo doubling", memoDoubling(64), "Pickle is nested more than 8 levels deep"},
+		{"deep nesting", "\x80\x02K\x01" + strings.Repeat("\x85", 100) + ".", "Pickle is nested more than 8 levels deep"},
+		{"too many elements", "\x80\x02K\x01q\x00(" + strings.Repeat("h\x00", pickleMaxElements+1) + "l.", "Pickle contains more than 262144 elements"},
+		{"global", "\x80\x02cos\nsystem\nq\x00.", "Pickle contains unsupported opcode 0x63"},
+		{"reduce", "\x80\x02K\x01K\x02R.", "Pickle contains unsupported opcode 0x52"},
+		{"unknown memo index", "\x80\x02h\x05.", "Pickle references unknown memo index 5"},
+		{"huge string", "\x80\x02T\xff\xff\xff\x7f", "Pickle contains a string of 2147483647 bytes"},
+		{"stack underflow", "\x80\x02\x86.", "Pickle stack underflow"},
+		{"truncated", "\x80\x02]q\x00(X\x05\x00\x00\x00a.b", "unexpected EOF"},
+		{"missing stop", "\x80\x02K\x01", "EOF"},
+	}
+
+	for _, test := range tests {
+		_, err := unpickle(bufio.NewReader(strings.NewReader(test.pickled)))
+		if err == nil {
+			t.Errorf("%s: expected error '%s', got none", test.name, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%s: expected error '%s', got '%s'", test.name, test.err, err.Error())
+		}
+	}
+}
+
+func TestProcessPickleSkipsInvalidMetrics(t *testing.T) {
+	s := &Server{
+		config:  &Config{},
+		storage: make(chan storage.Metric, 10),
+	}
+	rejections := newRejectionCounter(nil)
+
+	// [('a.b.c', (1500000000, 1.5)), ('', (1, 2)), ('a.b.d', 'x'), ('a.b.e', (1500000000, 2)),
+	//  ('a.b.f', (nan, 1)), ('a.b.g', (inf, 1)), ('a.b.h', ('-inf', 1))]
+	pickled := "\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cJ\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86" +
+		"X\x00\x00\x00\x00K\x01K\x02\x86\x86" +
+		"X\x05\x00\x00\x00a.b.dX\x01\x00\x00\x00x\x86" +
+		"X\x05\x00\x00\x00a.b.eJ\x00/hYK\x02\x86\x86" +
+		"X\x05\x00\x00\x00a.b.fG\x7f\xf8\x00\x00\x00\x00\x00\x00K\x01\x86\x86" +
+		"X\x05\x00\x00\x00a.b.gG\x7f\xf0\x00\x00\x00\x00\x00\x00K\x01\x86\x86" +
+		"X\x05\x00\x00\x00a.b.hX\x04\x00\x00\x00-infK\x01\x86\x86e."
+
+	if err := s.processPickle([]byte(pickled), rejections); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if rejections.count != 5 {
+		t.Errorf("Expected 5 rejections, got %d", rejections.count)
+	}
+	if len(s.storage) != 2 {
+		t.Fatalf("Expected 2 stored metrics, got %d", len(s.storage))
+	}
+
+	for _, key := range []string{"a.b.c", "a.b.e"} {
+		m := (<-s.storage).(*metric)
+		if m.key != key || !m.ts.Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("Expected %s at 1500000000, got %s at %s", key, m.key, m.ts)
+		}
+	}
+}
@@ -17,13 +17,13 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"chronodium/storage"
 	"chronodium/storage/redis"
+	chronodiumTime "chronodium/util/time"
 )
 
 type httpServer struct {
@@ -35,85 +35,120 @@ func Start(repo storage.Repo) {
 		repo: repo,
 	}
 
-	http.HandleFunc("/metrics/index.json",
+	// Not the default mux, which other listeners would serve as well
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/index.json",
 		func(w http.ResponseWriter, r *http.Request) { s.graphiteHandler(w, r) })
-	http.HandleFunc("/chrono-ts/query",
+	mux.HandleFunc("/chrono-ts/query",
 		func(w http.ResponseWriter, r *http.Request) { s.queryHandler(w, r) })
-	go http.ListenAndServe(":8080", nil)
+	mux.HandleFunc("/chrono-ts/delete",
+		func(w http.ResponseWriter, r *http.Request) { s.deleteHandler(w, r) })
+	mux.HandleFunc("/chrono-ts/stats",
+		func(w http.ResponseWriter, r *http.Request) { s.statsHandler(w, r) })
+	mux.HandleFunc("/chrono-ts/memory",
+		func(w http.ResponseWriter, r *http.Request) { s.memoryHandler(w, r) })
+	go http.ListenAndServe(":8080", mux)
 }
 
 func (s *httpServer) queryHandler(w http.ResponseWriter, r *http.Request) {
 	query := &storage.Query{Filter: make(map[string]string, 0), EndDate: time.Now(), StartDate: time.Now().Add(-1 * time.Hour)}
-	query.ShardKey = r.URL.Query().Get("pk")
-	if query.ShardKey == "" {
+	if err := s.parseQuery(r, query); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("No primary key specified"))
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	//var err error
-	if startDate := r.URL.Query().Get("start-date"); startDate != "" {
-		startDate, err := s.getTimeFromInput(startDate)
-		query.StartDate = startDate
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Could not parse start-date: " + err.Error()))
-			return
-		}
-	}
+	res := s.repo.Query(query).(redis.ResultSet)
 
-	if endDate := r.URL.Query().Get("end-date"); endDate != "" {
-		endDate, err := s.getTimeFromInput(endDate)
-		query.EndDate = endDate
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("Could not parse end-date: " + err.Error()))
-			return
-		}
+	json.NewEncoder(w).Encode(
+		struct {
+			Results redis.ResultSet `json:"results"`
+		}{Results: res},
+	)
+}
+
+func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
 
-	if filters, exists := r.URL.Query()["filter"]; exists {
-		for _, filterString := range filters {
-			parts := strings.Split(filterString, ":")
-			if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Invalid filter specified: " + filterString))
-				return
-			}
-
-			if _, exists := query.Filter[parts[0]]; exists {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Cannot use same filter key more than once: " + parts[0]))
-				return
-			}
-
-			query.Filter[parts[0]] = parts[1]
-		}
+	// Unlike queries, deletes are not limited to a time range by default
+	query := &storage.Query{Filter: make(map[string]string, 0)}
+	if err := s.parseQuery(r, query); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	res := s.repo.Query(query).(redis.ResultSet)
+	deleted, err := s.repo.Delete(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not delete: " + err.Error()))
+		return
+	}
 
 	json.NewEncoder(w).Encode(
 		struct {
-			Results redis.ResultSet `json:"results"`
-		}{Results: res},
+			Deleted int `json:"deleted"`
+		}{Deleted: deleted},
 	)
 }
 
-func (s *httpServer) getTimeFromInput(timeString string) (time.Time, error) {
-	out, err := time.Parse(time.RFC3339, timeString)
-	if err == nil {
-		return out, nil
-	}
+func (s *httpServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.repo.Stats())
+}
 
-	var timeInt int64
-	timeInt, err = strconv.ParseInt(timeString, 10, 64)
+func (s *httpServer) memoryHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.repo.GetMemoryUsage(r.URL.Query().Get("pattern"))
 	if err != nil {
-		return out, err
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not determine memory usage: " + err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *httpServer) parseQuery(r *http.Request, query *storage.Query) error {
+	query.ShardKey = r.URL.Query().Get("pk")
+	if query.ShardKey == "" {
+		return fmt.Errorf("No primary key specified")
 	}
 
-	return time.Unix(timeInt, 0), nil
+	if startDate := r.URL.Query().Get("start-date"); startDate != "" {
+		startDate, err := chronodiumTime.ParseTime(startDate)
+		if err != nil {
+			return fmt.Errorf("Could not parse start-date: %s", err.Error())
+		}
+		query.StartDate = startDate
+	}
+
+	if endDate := r.URL.Query().Get("end-date"); endDate != "" {
+		endDate, err := chronodiumTime.ParseTime(endDate)
+		if err != nil {
+			return fmt.Errorf("Could not parse end-date: %s", err.Error())
+		}
+		query.EndDate = endDate
+	}
+
+	if step := r.URL.Query().Get("step"); step != "" {
+		var err error
+		if query.Step, err = chronodiumTime.ParseDuration(step); err != nil {
+			return fmt.Errorf("Could not parse step: %s", err.Error())
+		}
+	}
+
+	for _, filterString := range r.URL.Query()["filter"] {
+		if err := query.AddFilter(filterString); err != nil {
+			return err
+		}
+	}
 
+	return nil
 }
 
 func (s *httpServer) graphiteHandler(w http.ResponseWriter, r *http.Request) {
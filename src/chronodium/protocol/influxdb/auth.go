@@ -0,0 +1,177 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials prefixed by this are the hex encoded SHA-256 hash of the
+// actual password or token, rather than the plaintext.
+const hashPrefix = "sha256:"
+
+const authReportInterval = 1 * time.Minute
+
+// credential is a password or token as configured
+type credential string
+
+func parseCredential(raw string) (credential, error) {
+	if strings.HasPrefix(raw, hashPrefix) {
+		hash, err := hex.DecodeString(raw[len(hashPrefix):])
+		if err != nil || len(hash) != sha256.Size {
+			return "", fmt.Errorf("Invalid SHA-256 hash: %s", raw)
+		}
+		return credential(raw), nil
+	}
+	if raw == "" {
+		return "", fmt.Errorf("Empty credentials are not allowed")
+	}
+
+	return credential(raw), nil
+}
+
+// matches compares the given secret in constant time
+func (c credential) matches(secret string) bool {
+	if strings.HasPrefix(string(c), hashPrefix) {
+		hash := sha256.Sum256([]byte(secret))
+		expected, _ := hex.DecodeString(string(c)[len(hashPrefix):])
+		return subtle.ConstantTimeCompare(hash[:], expected) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c), []byte(secret)) == 1
+}
+
+// authenticator checks the credentials of requests, if any users or tokens
+// have been configured.
+type authenticator struct {
+	users  map[string]credential
+	tokens []credential
+
+	lock       sync.Mutex
+	failures   int
+	lastRemote string
+}
+
+func newAuthenticator(config *Config) (*authenticator, error) {
+	a := &authenticator{
+		users:  make(map[string]credential, len(config.User)),
+		tokens: make([]credential, 0, len(config.Token)),
+	}
+
+	for _, user := range config.User {
+		parts := strings.SplitN(user, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid user specified, expected 'name:password'")
+		}
+		password, err := parseCredential(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid password for user %s: %s", parts[0], err.Error())
+		}
+		a.users[parts[0]] = password
+	}
+
+	for _, raw := range config.Token {
+		token, err := parseCredential(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token: %s", err.Error())
+		}
+		a.tokens = append(a.tokens, token)
+	}
+
+	return a, nil
+}
+
+func (a *authenticator) enabled() bool {
+	return a != nil && (len(a.users) > 0 || len(a.tokens) > 0)
+}
+
+// authenticate checks the credentials of a request. They are accepted as
+// basic auth, the u and p parameters, or a bearer token.
+func (a *authenticator) authenticate(r *http.Request) error {
+	if !a.enabled() {
+		return nil
+	}
+
+	ok := false
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") || strings.HasPrefix(auth, "Token ") {
+		token := strings.TrimSpace(auth[strings.IndexByte(auth, ' ')+1:])
+		for _, t := range a.tokens {
+			if t.matches(token) {
+				ok = true
+			}
+		}
+	} else if username, password, hasBasicAuth := r.BasicAuth(); hasBasicAuth {
+		ok = a.checkPassword(username, password)
+	} else if username := r.URL.Query().Get("u"); username != "" {
+		ok = a.checkPassword(username, r.URL.Query().Get("p"))
+	} else {
+		a.recordFailure(r)
+		return fmt.Errorf("unable to parse authentication credentials")
+	}
+
+	if !ok {
+		a.recordFailure(r)
+		return fmt.Errorf("authorization failed")
+	}
+
+	return nil
+}
+
+func (a *authenticator) checkPassword(username, password string) bool {
+	expected, exists := a.users[username]
+	return exists && expected.matches(password)
+}
+
+func (a *authenticator) recordFailure(r *http.Request) {
+	a.lock.Lock()
+	a.failures++
+	a.lastRemote = r.RemoteAddr
+	a.lock.Unlock()
+}
+
+// monitor periodically reports the number of failed attempts
+func (a *authenticator) monitor() {
+	ticker := time.NewTicker(authReportInterval)
+	for range ticker.C {
+		a.lock.Lock()
+		if a.failures > 0 {
+			log.Printf("Rejected %d InfluxDB requests with missing or invalid credentials, last from %s", a.failures, a.lastRemote)
+		}
+		a.failures = 0
+		a.lock.Unlock()
+	}
+}
+
+// requireAuth wraps a handler so that it is only called for authenticated requests
+func (s *Server) requireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.config.auth.authenticate(r); err != nil {
+			s.setVersionHeaders(w)
+			httpError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
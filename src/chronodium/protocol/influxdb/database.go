@@ -0,0 +1,83 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+
+	"chronodium/server/tier"
+)
+
+const (
+	UNKNOWN_DATABASE_ACCEPT = "accept" // Write to unknown databases as if no db was given (default)
+	UNKNOWN_DATABASE_REJECT = "reject" // Reject writes to databases that have not been configured
+)
+
+// Database maps writes to an InfluxDB database, and optionally a retention
+// policy, to a tier set and metadata. It is configured in sections named
+// after the database, or '<database>/<retention policy>' to apply to a
+// single retention policy only.
+type Database struct {
+	TierSet  string   `gcfg:"tier-set"` // Of which the retention applies to the points
+	Metadata []string // In the form of 'key:value'
+
+	metadata map[string]string
+}
+
+func (d *Database) Validate(tierSets map[string]*tier.TierSet) error {
+	if d.TierSet != "" {
+		if _, exists := tierSets[d.TierSet]; !exists {
+			return fmt.Errorf("Unknown tier set referenced: %s", d.TierSet)
+		}
+	}
+
+	d.metadata = make(map[string]string, len(d.Metadata))
+	for _, kv := range d.Metadata {
+		parts := strings.SplitN(kv, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid metadata specified: %s", kv)
+		}
+		d.metadata[parts[0]] = parts[1]
+	}
+
+	return nil
+}
+
+// getDatabase returns the mapping for the given database and retention
+// policy, or nil if there is none.
+func (c *Config) getDatabase(db, rp string) *Database {
+	if rp != "" {
+		if database, exists := c.databases[db+"/"+rp]; exists {
+			return database
+		}
+	}
+
+	return c.databases[db]
+}
+
+// getDatabaseNames returns the names of the configured databases
+func (c *Config) getDatabaseNames() []string {
+	out := make([]string, 0, len(c.databases))
+	for name := range c.databases {
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			name = name[:i]
+		}
+		out = append(out, name)
+	}
+
+	return out
+}
@@ -0,0 +1,76 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"testing"
+
+	"chronodium/server/tier"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestDatabaseTierSet(t *testing.T) {
+	tierSets := map[string]*tier.TierSet{"short": {}, "long": {}}
+	databases := map[string]*Database{
+		"telegraf":       {TierSet: "long", Metadata: []string{"_db:telegraf"}},
+		"telegraf/short": {TierSet: "short"},
+		"other":          {},
+	}
+
+	config := &Config{}
+	if err := config.Validate(databases, tierSets); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	tests := []struct {
+		db, rp  string
+		tierSet string
+	}{
+		{"telegraf", "", "long"},
+		{"telegraf", "autogen", "long"},
+		{"telegraf", "short", "short"},
+		{"other", "", ""},
+		{"unknown", "", ""},
+	}
+
+	points, err := models.ParsePoints([]byte("cpu,host=a value=1,idle=2i 1500000000000000000"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	for _, test := range tests {
+		metrics, _ := getMetricsFromInfluxPoint(points[0], config, config.getDatabase(test.db, test.rp))
+		if len(metrics) != 2 {
+			t.Fatalf("%s/%s: expected 2 metrics, got %d", test.db, test.rp, len(metrics))
+		}
+		for _, m := range metrics {
+			if m.TierSet() != test.tierSet {
+				t.Errorf("%s/%s: expected tier set %q, got %q", test.db, test.rp, test.tierSet, m.TierSet())
+			}
+		}
+	}
+}
+
+func TestDatabaseUnknownTierSet(t *testing.T) {
+	databases := map[string]*Database{"telegraf": {TierSet: "missing"}}
+
+	config := &Config{}
+	err := config.Validate(databases, map[string]*tier.TierSet{})
+	if err == nil || err.Error() != "Error parsing Database 'telegraf': Unknown tier set referenced: missing" {
+		t.Errorf("Expected an unknown tier set error, got %v", err)
+	}
+}
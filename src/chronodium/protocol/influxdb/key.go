@@ -0,0 +1,124 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Used when no key templates have been configured
+var defaultKeyTemplates = []string{
+	"{tag:vhost}__{measurement}",
+	"{tag:host}__{measurement}",
+}
+
+const (
+	partLiteral = iota
+	partMeasurement
+	partField
+	partTag
+)
+
+// keyTemplate derives the metric key from a point, e.g.
+// '{tag:datacenter}.{measurement}.{field}'.
+type keyTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	partType int
+	value    string // The literal or the name of the tag
+}
+
+func parseKeyTemplate(template string) (*keyTemplate, error) {
+	out := &keyTemplate{parts: make([]templatePart, 0)}
+
+	for remaining := template; remaining != ""; {
+		start := strings.IndexByte(remaining, '{')
+		if start == -1 {
+			out.parts = append(out.parts, templatePart{partLiteral, remaining})
+			break
+		}
+		if start > 0 {
+			out.parts = append(out.parts, templatePart{partLiteral, remaining[:start]})
+		}
+
+		end := strings.IndexByte(remaining[start:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("Unterminated placeholder in key template '%s'", template)
+		}
+
+		placeholder := remaining[start+1 : start+end]
+		switch {
+		case placeholder == "measurement":
+			out.parts = append(out.parts, templatePart{partType: partMeasurement})
+		case placeholder == "field":
+			out.parts = append(out.parts, templatePart{partType: partField})
+		case strings.HasPrefix(placeholder, "tag:") && len(placeholder) > len("tag:"):
+			out.parts = append(out.parts, templatePart{partTag, placeholder[len("tag:"):]})
+		default:
+			return nil, fmt.Errorf("Unknown placeholder '{%s}' in key template '%s'", placeholder, template)
+		}
+
+		remaining = remaining[start+end+1:]
+	}
+
+	if len(out.parts) == 0 {
+		return nil, fmt.Errorf("Key template must not be empty")
+	}
+
+	return out, nil
+}
+
+// render returns the key for the given point. Unless partial is true,
+// false is returned if any of the referenced tags is missing.
+func (t *keyTemplate) render(measurement, field string, tags map[string]string, partial bool) (string, bool) {
+	buf := &bytes.Buffer{}
+	for _, part := range t.parts {
+		switch part.partType {
+		case partLiteral:
+			buf.WriteString(part.value)
+		case partMeasurement:
+			buf.WriteString(measurement)
+		case partField:
+			buf.WriteString(field)
+		case partTag:
+			value, exists := tags[part.value]
+			if !exists && !partial {
+				return "", false
+			}
+			buf.WriteString(value)
+		}
+	}
+
+	return buf.String(), true
+}
+
+// deriveKey returns the key rendered by the first template of which all
+// referenced tags are present. If there is none, the last template is
+// used with the missing tags left empty.
+func deriveKey(templates []*keyTemplate, measurement, field string, tags map[string]string) string {
+	for _, template := range templates {
+		if key, ok := template.render(measurement, field, tags, false); ok {
+			return key
+		}
+	}
+
+	key, _ := templates[len(templates)-1].render(measurement, field, tags, true)
+	return key
+}
@@ -16,19 +16,27 @@
 package influxdb
 
 import (
-	"github.com/influxdata/influxdb/models"
+	"log"
+	"sync/atomic"
 	"time"
+
+	"chronodium/storage"
+
+	"github.com/influxdata/influxdb/models"
 )
 
 type metric struct {
-	point models.Point
-	value float64
+	config   *Config
+	database *Database
+	point    models.Point
+	field    string
+	value    storage.Value
 
 	key  string
 	tags map[string]string
 }
 
-func (m *metric) Value() float64 {
+func (m *metric) Value() storage.Value {
 	return m.value
 }
 
@@ -36,56 +44,114 @@ func (m *metric) Time() time.Time {
 	return m.point.Time()
 }
 
-// TODO: Move to lua
+// Key is derived from the point using the configured key templates
 func (m *metric) Key() string {
 	if m.key == "" {
-		if vhost, exists := m.Metadata()["vhost"]; exists {
-			m.key = vhost + "__" + string(m.point.Name())
-		} else {
-			m.key = m.Metadata()["host"] + "__" + string(m.point.Name())
+		tags := make(map[string]string, len(m.point.Tags()))
+		for _, tag := range m.point.Tags() {
+			tags[string(tag.Key)] = string(tag.Value)
 		}
+
+		m.key = deriveKey(m.config.keyTemplates, string(m.point.Name()), m.field, tags)
 	}
 
 	return m.key
 }
 
+// Metadata contains the (kept) tags of the point, as well as the
+// measurement (_key) and field (_field) the value belongs to, and the
+// metadata of the database that was written to.
 func (m *metric) Metadata() map[string]string {
 	if m.tags == nil {
-		m.tags = make(map[string]string, len(m.point.Tags())+1)
+		m.tags = make(map[string]string, len(m.point.Tags())+2)
 		m.tags["_key"] = string(m.point.Name())
+		m.tags["_field"] = m.field
 		for _, tag := range m.point.Tags() {
-			m.tags[string(tag.Key)] = string(tag.Value)
+			if m.config.keepsTag(string(tag.Key)) {
+				m.tags[string(tag.Key)] = string(tag.Value)
+			}
+		}
+		if m.database != nil {
+			for k, v := range m.database.metadata {
+				m.tags[k] = v
+			}
 		}
 	}
 
 	return m.tags
 }
 
-func getMetricsFromInfluxPoint(point models.Point) []*metric {
+// TierSet is that of the database that was written to, if any
+func (m *metric) TierSet() string {
+	if m.database == nil {
+		return ""
+	}
+
+	return m.database.TierSet
+}
+
+// How often the number of fields that were skipped is reported
+const skippedFieldsReportInterval = 1 * time.Minute
+
+// getMetrics returns a metric per field of the point. Fields of unsupported
+// types are counted, and reported periodically.
+func (s *Server) getMetrics(point models.Point, database *Database) []*metric {
+	metrics, skipped := getMetricsFromInfluxPoint(point, s.config, database)
+	if skipped > 0 {
+		atomic.AddUint64(&s.skippedFields, uint64(skipped))
+	}
+
+	return metrics
+}
+
+func (s *Server) reportSkippedFields() {
+	ticker := time.NewTicker(skippedFieldsReportInterval)
+	for range ticker.C {
+		if skipped := atomic.SwapUint64(&s.skippedFields, 0); skipped > 0 {
+			log.Printf("Skipped %d fields of unsupported types", skipped)
+		}
+	}
+}
+
+// getMetricsFromInfluxPoint returns a metric per field of the point, and the
+// number of fields of unsupported types that were skipped. The database is
+// nil if it has not been configured.
+func getMetricsFromInfluxPoint(point models.Point, config *Config, database *Database) ([]*metric, int) {
 	metrics := make([]*metric, 0)
+	skipped := 0
 
 	for _, p := range point.Split(1) {
 		iter := p.FieldIterator()
 		for iter.Next() { // Iterate over fields
-			var value float64
+			var value storage.Value
 			switch iter.Type() {
 			case models.Integer:
 				intVal, _ := iter.IntegerValue()
-				value = float64(intVal)
+				value = storage.IntegerValue(intVal)
 			case models.Float:
-				value, _ = iter.FloatValue()
+				floatVal, _ := iter.FloatValue()
+				value = storage.FloatValue(floatVal)
+			case models.Boolean:
+				boolVal, _ := iter.BooleanValue()
+				value = storage.BooleanValue(boolVal)
+			case models.String:
+				value = storage.StringValue(iter.StringValue())
 			default:
-				panic("Unsupported type in " + p.String())
+				skipped++
+				continue
 			}
 
 			m := &metric{
-				point: p,
-				value: value,
+				config:   config,
+				database: database,
+				point:    p,
+				field:    string(iter.FieldKey()),
+				value:    value,
 			}
 
 			metrics = append(metrics, m)
 		}
 	}
 
-	return metrics
+	return metrics, skipped
 }
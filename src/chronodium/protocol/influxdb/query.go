@@ -0,0 +1,216 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The InfluxDB version that is reported to clients, matching the line
+// protocol that is supported.
+const compatibleVersion = "1.3.0"
+
+// pingHandler lets clients check whether the server is up
+func (s *Server) pingHandler(w http.ResponseWriter, r *http.Request) {
+	s.setVersionHeaders(w)
+
+	if r.URL.Query().Get("verbose") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"version": compatibleVersion})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setVersionHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Influxdb-Build", "OSS")
+	w.Header().Set("X-Influxdb-Version", compatibleVersion)
+}
+
+type queryResponse struct {
+	Results []*statementResult `json:"results"`
+}
+
+type statementResult struct {
+	StatementId int       `json:"statement_id"`
+	Series      []*series `json:"series,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type series struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+// queryHandler supports just enough of InfluxQL for agents to manage their
+// database at startup. Databases do not exist as such, creating and
+// dropping them is a no-op and any database can be written to.
+func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
+	s.setVersionHeaders(w)
+
+	q := r.FormValue("q")
+	if strings.TrimSpace(q) == "" {
+		httpError(w, `missing required parameter "q"`, http.StatusBadRequest)
+		return
+	}
+
+	response := &queryResponse{Results: make([]*statementResult, 0)}
+	for _, statement := range splitStatements(q) {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+
+		result := s.executeStatement(statement)
+		result.StatementId = len(response.Results)
+		response.Results = append(response.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) executeStatement(statement string) *statementResult {
+	words := splitWords(statement)
+	for i := 0; i < len(words) && i < 2; i++ {
+		words[i] = strings.ToUpper(words[i])
+	}
+
+	switch {
+	case len(words) == 2 && (words[0] == "CREATE" || words[0] == "DROP") && words[1] == "DATABASE":
+		return &statementResult{Error: "database name required"}
+
+	case len(words) >= 3 && words[0] == "CREATE" && words[1] == "DATABASE":
+		s.databases.add(unquoteIdentifier(words[2]))
+		return &statementResult{}
+
+	case len(words) >= 3 && words[0] == "DROP" && words[1] == "DATABASE":
+		s.databases.remove(unquoteIdentifier(words[2]))
+		return &statementResult{}
+
+	case len(words) == 2 && words[0] == "SHOW" && words[1] == "DATABASES":
+		values := make([][]interface{}, 0)
+		for _, name := range s.databases.list() {
+			values = append(values, []interface{}{name})
+		}
+		return &statementResult{Series: []*series{{Name: "databases", Columns: []string{"name"}, Values: values}}}
+	}
+
+	return &statementResult{Error: fmt.Sprintf("statement not supported: %s", strings.TrimSpace(statement))}
+}
+
+// splitStatements splits a query into its statements, which are separated
+// by semicolons outside of quoted identifiers and strings.
+func splitStatements(q string) []string {
+	return splitQuoted(q, func(c byte) bool { return c == ';' })
+}
+
+// splitWords splits a statement into its words, which are separated by
+// whitespace outside of quoted identifiers and strings.
+func splitWords(statement string) []string {
+	words := make([]string, 0)
+	for _, word := range splitQuoted(statement, func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+	}) {
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+
+	return words
+}
+
+// splitQuoted splits a string at the characters for which isSeparator
+// returns true, unless they are within quotes.
+func splitQuoted(q string, isSeparator func(c byte) bool) []string {
+	parts := make([]string, 0)
+	var quote byte
+	start := 0
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '"' || c == '\'':
+			quote = c
+		case isSeparator(c):
+			parts = append(parts, q[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, q[start:])
+}
+
+// unquoteIdentifier strips the quotes of a double quoted identifier
+func unquoteIdentifier(identifier string) string {
+	if len(identifier) >= 2 && identifier[0] == '"' && identifier[len(identifier)-1] == '"' {
+		return strings.Replace(identifier[1:len(identifier)-1], `\"`, `"`, -1)
+	}
+
+	return identifier
+}
+
+// databaseList keeps track of the configured databases and those created
+// by clients, so that they can be listed again.
+type databaseList struct {
+	lock  sync.Mutex
+	names map[string]bool
+}
+
+func newDatabaseList(names []string) *databaseList {
+	out := &databaseList{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		out.names[name] = true
+	}
+
+	return out
+}
+
+func (d *databaseList) add(name string) {
+	d.lock.Lock()
+	d.names[name] = true
+	d.lock.Unlock()
+}
+
+func (d *databaseList) remove(name string) {
+	d.lock.Lock()
+	delete(d.names, name)
+	d.lock.Unlock()
+}
+
+func (d *databaseList) list() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	out := make([]string, 0, len(d.names))
+	for name := range d.names {
+		out = append(out, name)
+	}
+
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,97 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		query      string
+		statements []string
+	}{
+		{"SHOW DATABASES", []string{"SHOW DATABASES"}},
+		{"CREATE DATABASE a; SHOW DATABASES;", []string{"CREATE DATABASE a", " SHOW DATABASES", ""}},
+		{`CREATE DATABASE "a;b"; SHOW DATABASES`, []string{`CREATE DATABASE "a;b"`, " SHOW DATABASES"}},
+		{`CREATE DATABASE "a\";b"; DROP DATABASE c`, []string{`CREATE DATABASE "a\";b"`, " DROP DATABASE c"}},
+		{`SELECT * FROM m WHERE t = 'x;y'; SHOW DATABASES`, []string{`SELECT * FROM m WHERE t = 'x;y'`, " SHOW DATABASES"}},
+		{`SELECT * FROM m WHERE t = 'it\'s;'`, []string{`SELECT * FROM m WHERE t = 'it\'s;'`}},
+		{`CREATE DATABASE "a'b"; SHOW DATABASES`, []string{`CREATE DATABASE "a'b"`, " SHOW DATABASES"}},
+		{`CREATE DATABASE "unterminated; SHOW DATABASES`, []string{`CREATE DATABASE "unterminated; SHOW DATABASES`}},
+	}
+
+	for _, test := range tests {
+		if statements := splitStatements(test.query); !reflect.DeepEqual(statements, test.statements) {
+			t.Errorf("%s: expected %q, got %q", test.query, test.statements, statements)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		statement string
+		words     []string
+	}{
+		{"SHOW DATABASES", []string{"SHOW", "DATABASES"}},
+		{" SHOW \t DATABASES\n", []string{"SHOW", "DATABASES"}},
+		{`CREATE DATABASE "my db"`, []string{"CREATE", "DATABASE", `"my db"`}},
+		{`CREATE DATABASE "my \" db" WITH DURATION 1d`, []string{"CREATE", "DATABASE", `"my \" db"`, "WITH", "DURATION", "1d"}},
+		{"", []string{}},
+	}
+
+	for _, test := range tests {
+		if words := splitWords(test.statement); !reflect.DeepEqual(words, test.words) {
+			t.Errorf("%q: expected %q, got %q", test.statement, test.words, words)
+		}
+	}
+}
+
+func TestExecuteStatement(t *testing.T) {
+	s := &Server{databases: newDatabaseList([]string{"telegraf"})}
+
+	tests := []struct {
+		statement string
+		err       string
+		databases []string
+	}{
+		{`CREATE DATABASE "my db"`, "", []string{"my db", "telegraf"}},
+		{"create  database\tother", "", []string{"my db", "other", "telegraf"}},
+		{`DROP DATABASE "my db"`, "", []string{"other", "telegraf"}},
+		{"CREATE DATABASE", "database name required", []string{"other", "telegraf"}},
+		{"DROP  DATABASE ", "database name required", []string{"other", "telegraf"}},
+		{"SHOW MEASUREMENTS", "statement not supported: SHOW MEASUREMENTS", []string{"other", "telegraf"}},
+	}
+
+	for _, test := range tests {
+		if result := s.executeStatement(test.statement); result.Error != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.statement, test.err, result.Error)
+		}
+
+		result := s.executeStatement("SHOW  DATABASES")
+		if result.Error != "" || len(result.Series) != 1 {
+			t.Fatalf("%q: could not show databases: %s", test.statement, result.Error)
+		}
+		databases := make([]string, 0)
+		for _, value := range result.Series[0].Values {
+			databases = append(databases, value[0].(string))
+		}
+		if !reflect.DeepEqual(databases, test.databases) {
+			t.Errorf("%q: expected databases %q, got %q", test.statement, test.databases, databases)
+		}
+	}
+}
@@ -16,12 +16,16 @@
 package influxdb
 
 import (
-	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"time"
 
+	"chronodium/server/tier"
 	"chronodium/storage"
 	"chronodium/util/stop"
 
@@ -32,12 +36,123 @@ type Config struct {
 	Enable bool
 	Port   int
 	Bind   net.IP
+
+	// Templates to derive the metric key from, the first template of which
+	// all referenced tags are present is used. E.g. '{tag:host}.{measurement}'
+	KeyTemplate []string `gcfg:"key-template"`
+
+	// Limit the tags that are stored as metadata. If any tags to keep are
+	// specified, all others are dropped.
+	KeepTag []string `gcfg:"keep-tag"`
+	DropTag []string `gcfg:"drop-tag"`
+
+	// What to do with writes to databases that have not been configured,
+	// see the UNKNOWN_DATABASE_* constants.
+	UnknownDatabase string `gcfg:"unknown-database"`
+
+	// The maximum size of a (decompressed) write request in bytes
+	MaxBodySize int64 `gcfg:"max-body-size"`
+
+	// Require writes to authenticate as any of the users ('name:password')
+	// or with any of the tokens, if given. Passwords and tokens can also be
+	// given as 'sha256:' followed by the hex encoded hash.
+	User  []string
+	Token []string
+
+	// Also accept line protocol over UDP. Points are written as if they
+	// were written to the given database, with the given precision.
+	UdpEnable     bool   `gcfg:"udp-enable"`
+	UdpPort       int    `gcfg:"udp-port"`        // Defaults to the HTTP port
+	UdpReadBuffer int    `gcfg:"udp-read-buffer"` // Socket receive buffer in bytes, zero for the OS default
+	UdpPrecision  string `gcfg:"udp-precision"`
+	UdpBatchSize  int    `gcfg:"udp-batch-size"`
+	UdpDatabase   string `gcfg:"udp-database"`
+
+	keyTemplates []*keyTemplate
+	keepTags     map[string]bool
+	dropTags     map[string]bool
+	databases    map[string]*Database
+	auth         *authenticator
+}
+
+func (c *Config) Validate(databases map[string]*Database, tierSets map[string]*tier.TierSet) error {
+	switch c.UnknownDatabase {
+	case "":
+		c.UnknownDatabase = UNKNOWN_DATABASE_ACCEPT
+	case UNKNOWN_DATABASE_ACCEPT, UNKNOWN_DATABASE_REJECT:
+	default:
+		return fmt.Errorf("Unknown unknown-database policy: %s", c.UnknownDatabase)
+	}
+
+	var err error
+	if c.auth, err = newAuthenticator(c); err != nil {
+		return err
+	}
+
+	if c.UdpPrecision, err = validatePrecision(c.UdpPrecision); err != nil {
+		return err
+	}
+	if c.UdpBatchSize <= 0 {
+		c.UdpBatchSize = DEFAULT_UDP_BATCH_SIZE
+	}
+
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+
+	for k, v := range databases {
+		if err := v.Validate(tierSets); err != nil {
+			return fmt.Errorf("Error parsing Database '%s': %s", k, err.Error())
+		}
+	}
+	c.databases = databases
+
+	if c.UdpEnable && c.UnknownDatabase == UNKNOWN_DATABASE_REJECT && c.getDatabase(c.UdpDatabase, "") == nil {
+		return fmt.Errorf("The udp-database '%s' must be configured when unknown databases are rejected", c.UdpDatabase)
+	}
+
+	rawTemplates := c.KeyTemplate
+	if len(rawTemplates) == 0 {
+		rawTemplates = defaultKeyTemplates
+	}
+
+	c.keyTemplates = make([]*keyTemplate, len(rawTemplates))
+	for k, v := range rawTemplates {
+		if c.keyTemplates[k], err = parseKeyTemplate(v); err != nil {
+			return err
+		}
+	}
+
+	c.keepTags = make(map[string]bool, len(c.KeepTag))
+	for _, tag := range c.KeepTag {
+		c.keepTags[tag] = true
+	}
+
+	c.dropTags = make(map[string]bool, len(c.DropTag))
+	for _, tag := range c.DropTag {
+		c.dropTags[tag] = true
+	}
+
+	return nil
+}
+
+// keepsTag reports whether a tag is to be stored as metadata
+func (c *Config) keepsTag(tag string) bool {
+	if len(c.keepTags) > 0 && !c.keepTags[tag] {
+		return false
+	}
+
+	return !c.dropTags[tag]
 }
 
 type Server struct {
 	config  *Config
 	stopper *stop.Stopper
 	storage chan storage.Metric
+
+	databases     *databaseList
+	udpCounters   udpCounters
+	skippedFields uint64 // Since the last report
 }
 
 func NewServer(config *Config, stopper *stop.Stopper) *Server {
@@ -45,48 +160,126 @@ func NewServer(config *Config, stopper *stop.Stopper) *Server {
 		config:  config,
 		stopper: stopper,
 		storage: make(chan storage.Metric, 1024),
+
+		databases: newDatabaseList(config.getDatabaseNames()),
 	}
 }
 
 func (s *Server) Start() error {
-	http.HandleFunc("/write",
+	// Not the default mux, which would expose the handlers of other listeners
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write",
 		func(w http.ResponseWriter, r *http.Request) { s.writeHandler(w, r) })
-	go http.ListenAndServe(s.config.Bind.String()+":"+strconv.Itoa(s.config.Port), nil)
+	mux.HandleFunc("/query",
+		func(w http.ResponseWriter, r *http.Request) { s.queryHandler(w, r) })
+
+	// Like InfluxDB, only pings are answered without credentials
+	root := http.NewServeMux()
+	root.HandleFunc("/ping",
+		func(w http.ResponseWriter, r *http.Request) { s.pingHandler(w, r) })
+	root.Handle("/", s.requireAuth(mux))
+	go http.ListenAndServe(s.config.Bind.String()+":"+strconv.Itoa(s.config.Port), root)
+
+	if s.config.auth.enabled() {
+		go s.config.auth.monitor()
+	}
+	go s.reportSkippedFields()
 
+	if s.config.UdpEnable {
+		return s.startUdp()
+	}
 	return nil
 }
 
 func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
-	var bs []byte
-	buf := bytes.NewBuffer(bs)
+	s.setVersionHeaders(w)
+
+	db, rp := r.URL.Query().Get("db"), r.URL.Query().Get("rp")
+	database := s.config.getDatabase(db, rp)
+	if database == nil && s.config.UnknownDatabase == UNKNOWN_DATABASE_REJECT {
+		if db == "" {
+			httpError(w, "database name required", http.StatusBadRequest)
+		} else {
+			httpError(w, fmt.Sprintf("database not found: %q", db), http.StatusNotFound)
+		}
+		return
+	}
 
-	_, err := buf.ReadFrom(r.Body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	// The size of an uncompressed body is known up front, so it can be
+	// rejected before anything is stored
+	gzipped := r.Header.Get("Content-Encoding") == "gzip"
+	if !gzipped && r.ContentLength > s.config.MaxBodySize {
+		httpError(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	points, parseError := models.ParsePointsWithPrecision(buf.Bytes(), time.Now().UTC(), r.URL.Query().Get("precision"))
-	if parseError != nil && len(points) == 0 {
-		if parseError.Error() == "EOF" {
-			w.WriteHeader(http.StatusOK)
+	body := r.Body
+	if gzipped {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		defer gz.Close()
+		body = gz
+	}
+
+	// Nothing is stored until the whole body has been read, as a body that
+	// turns out to be too large is refused entirely and retried by clients.
+	// The points held are bounded by the maximum body size.
+	chunks := newChunkReader(body, s.config.MaxBodySize)
+	points := make([]models.Point, 0)
+	rejected := 0
+	var parseError string
+	for {
+		chunk, err := chunks.next()
+		if err == io.EOF {
+			break
+		} else if err == errBodyTooLarge {
+			httpError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			httpError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		parsed, err := models.ParsePointsWithPrecision(chunk, time.Now().UTC(), r.URL.Query().Get("precision"))
+		if errors := parseErrors(err); len(errors) > 0 {
+			if parseError == "" {
+				parseError = errors[0]
+			}
+			rejected += len(errors)
+		}
+		points = append(points, parsed...)
 	}
 
 	for _, point := range points {
-		for _, m := range getMetricsFromInfluxPoint(point) {
-			//fmt.Println(m.Time(), m.Key(), m.Value(), m.Metadata())
+		for _, m := range s.getMetrics(point, database) {
 			s.storage <- m
 		}
+	}
+	written := len(points)
 
+	// Like InfluxDB, the valid points are stored even if others were rejected
+	if rejected > 0 && written == 0 {
+		httpError(w, fmt.Sprintf("%s dropped=%d", parseError, rejected), http.StatusBadRequest)
+		return
+	} else if rejected > 0 {
+		httpError(w, fmt.Sprintf("partial write: %s dropped=%d", parseError, rejected), http.StatusBadRequest)
+		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// httpError writes an error response in the format of InfluxDB
+func httpError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", message)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
 func (s *Server) Metrics() <-chan storage.Metric {
 	return s.storage
 }
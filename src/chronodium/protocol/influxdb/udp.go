@@ -0,0 +1,169 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// The maximum size of a UDP datagram
+const udpDatagramSize = 65536
+
+const (
+	DEFAULT_UDP_BATCH_SIZE = 5000
+
+	// Batches are flushed at least this often, even if not full
+	udpBatchTimeout = 1 * time.Second
+
+	// The number of batches that may wait to be stored, further batches
+	// are dropped so that reading from the socket is never blocked.
+	udpBatchPending = 10
+
+	udpReportInterval = 1 * time.Minute
+)
+
+// udpCounters keeps track of the points received over UDP that could not be
+// stored. Senders never learn about these, so they are reported periodically.
+type udpCounters struct {
+	invalid uint64 // Lines that could not be parsed
+	dropped uint64 // Points dropped because the storage did not keep up
+}
+
+// validatePrecision checks and normalizes the precision of UDP writes
+func validatePrecision(precision string) (string, error) {
+	switch precision {
+	case "", "n", "ns":
+		return "n", nil
+	case "u", "us":
+		return "u", nil
+	case "ms", "s", "m", "h":
+		return precision, nil
+	}
+
+	return "", fmt.Errorf("Unknown precision: %s", precision)
+}
+
+func (s *Server) startUdp() error {
+	port := s.config.UdpPort
+	if port == 0 {
+		port = s.config.Port
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", s.config.Bind.String()+":"+strconv.Itoa(port))
+	if nil != err {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if nil != err {
+		return err
+	}
+
+	if s.config.UdpReadBuffer > 0 {
+		if err := conn.SetReadBuffer(s.config.UdpReadBuffer); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	log.Printf("listening on udp %s", conn.LocalAddr())
+
+	batches := make(chan []*metric, udpBatchPending)
+	go s.serveUdp(conn, batches)
+	go s.storeBatches(batches)
+	go s.reportUdpCounters()
+	return nil
+}
+
+func (s *Server) serveUdp(conn *net.UDPConn, batches chan<- []*metric) {
+	defer conn.Close()
+	defer close(batches)
+
+	database := s.config.getDatabase(s.config.UdpDatabase, "")
+	buf := make([]byte, udpDatagramSize)
+	batch := make([]*metric, 0, s.config.UdpBatchSize)
+	flushed := time.Now()
+
+	for {
+		select {
+		case <-s.stopper.ShouldStop():
+			log.Println("stopping listening on", conn.LocalAddr())
+			if len(batch) > 0 {
+				batches <- batch
+			}
+			return
+		default:
+		}
+
+		if len(batch) >= s.config.UdpBatchSize || (len(batch) > 0 && time.Since(flushed) >= udpBatchTimeout) {
+			select {
+			case batches <- batch:
+			default:
+				atomic.AddUint64(&s.udpCounters.dropped, uint64(len(batch)))
+			}
+			batch = make([]*metric, 0, s.config.UdpBatchSize)
+			flushed = time.Now()
+		}
+
+		conn.SetReadDeadline(time.Now().Add(udpBatchTimeout))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			log.Println(err)
+			continue
+		}
+
+		// Points keep referring to the data they were parsed from
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		points, err := models.ParsePointsWithPrecision(datagram, time.Now().UTC(), s.config.UdpPrecision)
+		if errors := parseErrors(err); len(errors) > 0 {
+			atomic.AddUint64(&s.udpCounters.invalid, uint64(len(errors)))
+		}
+
+		for _, point := range points {
+			batch = append(batch, s.getMetrics(point, database)...)
+		}
+	}
+}
+
+func (s *Server) storeBatches(batches <-chan []*metric) {
+	for batch := range batches {
+		for _, m := range batch {
+			s.storage <- m
+		}
+	}
+}
+
+func (s *Server) reportUdpCounters() {
+	ticker := time.NewTicker(udpReportInterval)
+	for range ticker.C {
+		if invalid := atomic.SwapUint64(&s.udpCounters.invalid, 0); invalid > 0 {
+			log.Printf("Ignored %d invalid lines received over UDP", invalid)
+		}
+		if dropped := atomic.SwapUint64(&s.udpCounters.dropped, 0); dropped > 0 {
+			log.Printf("Dropped %d points received over UDP because the storage did not keep up", dropped)
+		}
+	}
+}
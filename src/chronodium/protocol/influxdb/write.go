@@ -0,0 +1,139 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Points are parsed in chunks of about this size while the body is read, so
+// that the body does not have to be read entirely before parsing it.
+const writeChunkSize = 1 << 20
+
+const DEFAULT_MAX_BODY_SIZE = 25000000
+
+var errBodyTooLarge = errors.New("request entity too large")
+
+// parseErrors returns an error per line that could not be parsed, from the
+// error returned by models.ParsePoints.
+func parseErrors(err error) []string {
+	if err == nil || err.Error() == "EOF" {
+		return nil
+	}
+
+	return strings.Split(err.Error(), "\n")
+}
+
+// chunkReader splits a body of line protocol into chunks of whole lines,
+// and fails once more than the maximum number of bytes has been read.
+type chunkReader struct {
+	reader  *bufio.Reader
+	maxSize int64
+	read    int64
+	scanner lineScanner
+}
+
+func newChunkReader(body io.Reader, maxSize int64) *chunkReader {
+	return &chunkReader{
+		reader:  bufio.NewReader(body),
+		maxSize: maxSize,
+		scanner: lineScanner{lineStart: true},
+	}
+}
+
+// next returns the next chunk, or io.EOF once the body has been read
+func (c *chunkReader) next() ([]byte, error) {
+	chunk := make([]byte, 0, writeChunkSize)
+	for len(chunk) < writeChunkSize || !c.scanner.lineStart {
+		line, err := c.reader.ReadSlice('\n')
+		c.read += int64(len(line))
+		if c.read > c.maxSize {
+			return nil, errBodyTooLarge
+		}
+		c.scanner.scan(line)
+		chunk = append(chunk, line...)
+
+		if err == io.EOF {
+			if len(chunk) == 0 {
+				return nil, io.EOF
+			}
+			return chunk, nil
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+
+	return chunk, nil
+}
+
+const (
+	sectionKey = iota
+	sectionFields
+	sectionTimestamp
+)
+
+// lineScanner keeps track of where in a line of line protocol the data read
+// so far ends. Only string field values are quoted, and may contain
+// newlines; quotes anywhere else are taken literally.
+type lineScanner struct {
+	section   int
+	escaped   bool
+	quoted    bool
+	comment   bool
+	space     bool
+	lineStart bool
+}
+
+func (s *lineScanner) scan(data []byte) {
+	for _, b := range data {
+		lineStart, space := s.lineStart, s.space
+		s.lineStart, s.space = false, false
+
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case s.comment:
+			if b == '\n' {
+				s.comment = false
+				s.lineStart = true
+			}
+		case s.quoted:
+			if b == '\\' {
+				s.escaped = true
+			} else if b == '"' {
+				s.quoted = false
+			}
+		case b == '\\':
+			s.escaped = true
+		case b == '#' && lineStart:
+			s.comment = true
+		case b == '"' && s.section == sectionFields:
+			s.quoted = true
+		case b == ' ':
+			// Sections may be separated by more than one space
+			if !space && s.section != sectionTimestamp {
+				s.section++
+			}
+			s.space = true
+		case b == '\n':
+			s.section = sectionKey
+			s.lineStart = true
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronodium/util/stop"
+)
+
+func readChunks(body string, maxSize int64) ([]string, error) {
+	reader := newChunkReader(strings.NewReader(body), maxSize)
+	var chunks []string
+	for {
+		chunk, err := reader.next()
+		if err == io.EOF {
+			return chunks, nil
+		} else if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, string(chunk))
+	}
+}
+
+func TestLineScanner(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []string
+		lineStart bool
+	}{
+		{"empty", []string{""}, true},
+		{"complete line", []string{"cpu,host=a value=1 1500000000\n"}, true},
+		{"incomplete line", []string{"cpu,host=a value=1"}, false},
+		{"comment", []string{"# a comment with a \" quote\n"}, true},
+		{"quote in measurement", []string{"c\"pu value=1\n"}, true},
+		{"quote in tag value", []string{"cpu,host=\"a value=1\n"}, true},
+		{"quote in tag value and field value", []string{"cpu,host=\"a value=\"x\"\n"}, true},
+		{"newline in string field", []string{"cpu value=\"a\n", "b\"\n"}, true},
+		{"open string field", []string{"cpu value=\"a\n", "b\n"}, false},
+		{"escaped quote in string field", []string{"cpu value=\"a\\\"\n"}, false},
+		{"escaped backslash in string field", []string{"cpu value=\"a\\\\\"\n"}, true},
+		{"escaped newline", []string{"cpu,host=a\\\n"}, false},
+		{"multiple spaces", []string{"cpu,host=a  value=\"a\n"}, false},
+		{"quote in timestamp", []string{"cpu value=1 15\"\n"}, true},
+		{"quote split across reads", []string{"cpu value=\"a", "\n\"\n"}, true},
+	}
+
+	for _, test := range tests {
+		s := lineScanner{lineStart: true}
+		for _, data := range test.data {
+			s.scan([]byte(data))
+		}
+		if s.lineStart != test.lineStart {
+			t.Errorf("%s: expected the line start to be %v", test.name, test.lineStart)
+		}
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	line := "cpu,host=a value=1 1500000000\n"
+	lines := writeChunkSize/len(line) + 1
+	body := strings.Repeat(line, 2*lines)
+
+	chunks, err := readChunks(body, int64(len(body)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := []string{strings.Repeat(line, lines), strings.Repeat(line, lines)}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Errorf("Expected 2 chunks of %d lines, got %d chunks", lines, len(chunks))
+	}
+}
+
+func TestChunkReaderQuotes(t *testing.T) {
+	line := "cpu,host=\"a value=1\n"
+	lines := writeChunkSize/len(line) + 1
+	body := strings.Repeat(line, 2*lines)
+
+	// An unbalanced quote in a tag value must not prevent chunking
+	chunks, err := readChunks(body, int64(len(body)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(chunks) != 2 || chunks[0] != strings.Repeat(line, lines) {
+		t.Errorf("Expected 2 chunks of %d lines, got %d chunks", lines, len(chunks))
+	}
+
+	// A string field value spanning the chunk size stays in one chunk
+	prefix := strings.Repeat("cpu value=1\n", writeChunkSize/12-1)
+	field := "cpu value=\"" + strings.Repeat("a\n", 20) + "\"\n"
+	chunks, err = readChunks(prefix+field+line, 1<<30)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(chunks) != 2 || chunks[0] != prefix+field || chunks[1] != line {
+		t.Errorf("Expected the string field value to end the first chunk, got %d chunks", len(chunks))
+	}
+}
+
+func TestChunkReaderMaxSize(t *testing.T) {
+	tests := []struct {
+		body    string
+		maxSize int64
+		err     error
+	}{
+		{"cpu value=1\n", 12, nil},
+		{"cpu value=1\n", 11, errBodyTooLarge},
+		{"cpu value=1\ncpu value=2\n", 20, errBodyTooLarge},
+		{"cpu value=1", 11, nil},
+	}
+
+	for _, test := range tests {
+		if _, err := readChunks(test.body, test.maxSize); err != test.err {
+			t.Errorf("%q with a maximum of %d bytes: expected %v, got %v", test.body, test.maxSize, test.err, err)
+		}
+	}
+}
+
+func TestWriteHandlerBodyTooLarge(t *testing.T) {
+	line := "cpu,host=a value=1 1500000000000000000\n"
+	lines := writeChunkSize/len(line) + 1
+	body := strings.Repeat(line, 2*lines)
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write([]byte(body))
+	gz.Close()
+
+	config := &Config{MaxBodySize: int64(len(body) - 1)}
+	if err := config.Validate(nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s := NewServer(config, stop.NewStopper())
+
+	// The first chunk fits, but must not be stored as the body is refused
+	r := httptest.NewRequest("POST", "/write?db=telegraf", buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	s.writeHandler(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if len(s.storage) != 0 {
+		t.Errorf("Expected no metrics to be stored, got %d", len(s.storage))
+	}
+}
@@ -0,0 +1,87 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package relabel
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"chronodium/storage"
+)
+
+const dropReportInterval = 1 * time.Minute
+
+// Pipeline applies an ordered list of rules to all metrics of a source
+type Pipeline struct {
+	name  string
+	rules []*Rule
+
+	dropped uint64
+}
+
+func NewPipeline(name string, rules []*Rule) *Pipeline {
+	return &Pipeline{
+		name:  name,
+		rules: rules,
+	}
+}
+
+func (p *Pipeline) Process(src <-chan storage.Metric) <-chan storage.Metric {
+	out := make(chan storage.Metric, cap(src))
+
+	go func() {
+		for m := range src {
+			if relabeled := p.relabel(m); relabeled != nil {
+				out <- relabeled
+			} else {
+				atomic.AddUint64(&p.dropped, 1)
+			}
+		}
+		close(out)
+	}()
+
+	go p.reportDrops()
+	return out
+}
+
+// relabel returns the metric with all rules applied, or nil if it was dropped
+func (p *Pipeline) relabel(m storage.Metric) storage.Metric {
+	labels := make(map[string]string, len(m.Metadata())+1)
+	for k, v := range m.Metadata() {
+		labels[k] = v
+	}
+	labels[KeyLabel] = m.Key()
+
+	for _, rule := range p.rules {
+		if !rule.apply(labels) {
+			return nil
+		}
+	}
+
+	key := labels[KeyLabel]
+	delete(labels, KeyLabel)
+	return storage.NewMetric(key, m.Value(), m.Time(), labels, m.TierSet())
+}
+
+func (p *Pipeline) reportDrops() {
+	ticker := time.NewTicker(dropReportInterval)
+	for range ticker.C {
+		if dropped := atomic.SwapUint64(&p.dropped, 0); dropped > 0 {
+			log.Printf("Relabeling dropped %d metrics of source %s", dropped, p.name)
+		}
+	}
+}
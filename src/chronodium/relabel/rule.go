@@ -0,0 +1,182 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package relabel
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/twmb/murmur3"
+)
+
+// The pseudo label through which rules can read and write the metric key
+const KeyLabel = "__key__"
+
+const (
+	ActionReplace   = "replace"
+	ActionKeep      = "keep"
+	ActionDrop      = "drop"
+	ActionHashMod   = "hashmod"
+	ActionLabelMap  = "labelmap"
+	ActionLabelDrop = "labeldrop"
+)
+
+type orderableRules []*Rule
+
+// Rule is a relabel rule as known from Prometheus. The values of the source
+// labels are joined by the separator and matched against the (anchored)
+// regex. Metadata keys are used as label names, the metric key is available
+// as KeyLabel.
+type Rule struct {
+	Action       string
+	SourceLabels []string `gcfg:"source-label"`
+	Separator    string
+	Match        string `gcfg:"regex"`
+	TargetLabel  string `gcfg:"target-label"`
+	Replacement  string
+	Modulus      uint64
+
+	Order int
+	Regex *regexp.Regexp
+	Id    string
+}
+
+func (r *Rule) Validate() error {
+	if r.Action == "" {
+		r.Action = ActionReplace
+	}
+	if r.Separator == "" {
+		r.Separator = ";"
+	}
+	if r.Match == "" {
+		r.Match = "(.*)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+
+	var err error
+	if r.Regex, err = regexp.Compile("^(?:" + r.Match + ")$"); err != nil {
+		return fmt.Errorf("Could not parse regex %s: %s", r.Match, err.Error())
+	}
+
+	switch r.Action {
+	case ActionReplace, ActionHashMod:
+		if r.TargetLabel == "" {
+			return fmt.Errorf("Action %s requires a target-label", r.Action)
+		}
+		if r.Action == ActionHashMod && r.Modulus == 0 {
+			return fmt.Errorf("Action %s requires a modulus", r.Action)
+		}
+	case ActionKeep, ActionDrop:
+		if len(r.SourceLabels) == 0 {
+			return fmt.Errorf("Action %s requires at least one source-label", r.Action)
+		}
+	case ActionLabelMap, ActionLabelDrop:
+	default:
+		return fmt.Errorf("Unknown action: %s", r.Action)
+	}
+
+	return nil
+}
+
+func GetOrderedRules(rules map[string]*Rule) []*Rule {
+	out := make([]*Rule, 0, len(rules))
+	for k, v := range rules {
+		v.Id = k
+		out = append(out, v)
+	}
+
+	sort.Sort(orderableRules(out))
+	return out
+}
+
+// apply applies the rule to the given labels, which are modified in place.
+// Returns false if the metric is to be dropped.
+func (r *Rule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, label := range r.SourceLabels {
+		values[i] = labels[label]
+	}
+	value := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case ActionKeep:
+		return r.Regex.MatchString(value)
+
+	case ActionDrop:
+		return !r.Regex.MatchString(value)
+
+	case ActionReplace:
+		indexes := r.Regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+
+		target := string(r.Regex.ExpandString(nil, r.TargetLabel, value, indexes))
+		replacement := string(r.Regex.ExpandString(nil, r.Replacement, value, indexes))
+		setLabel(labels, target, replacement)
+
+	case ActionHashMod:
+		setLabel(labels, r.TargetLabel, strconv.FormatUint(murmur3.Sum64([]byte(value))%r.Modulus, 10))
+
+	case ActionLabelMap:
+		mapped := make(map[string]string, 0)
+		for label, labelValue := range labels {
+			if label != KeyLabel && r.Regex.MatchString(label) {
+				mapped[r.Regex.ReplaceAllString(label, r.Replacement)] = labelValue
+			}
+		}
+		for label, labelValue := range mapped {
+			labels[label] = labelValue
+		}
+
+	case ActionLabelDrop:
+		for label := range labels {
+			if label != KeyLabel && r.Regex.MatchString(label) {
+				delete(labels, label)
+			}
+		}
+	}
+
+	return true
+}
+
+// setLabel sets a label, labels set to an empty value are removed. The
+// metric key cannot be removed.
+func setLabel(labels map[string]string, label, value string) {
+	if value != "" {
+		labels[label] = value
+	} else if label != KeyLabel {
+		delete(labels, label)
+	}
+}
+
+func (s orderableRules) Len() int {
+	return len(s)
+}
+func (s orderableRules) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s orderableRules) Less(i, j int) bool {
+	if s[i].Order == s[j].Order {
+		return s[i].Id < s[j].Id
+	}
+	return s[i].Order < s[j].Order
+}
@@ -0,0 +1,196 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package relabel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"chronodium/storage"
+)
+
+func newRules(t *testing.T, rules ...*Rule) []*Rule {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			t.Fatalf("Invalid rule: %s", err.Error())
+		}
+	}
+	return rules
+}
+
+func TestRelabel(t *testing.T) {
+	metadata := map[string]string{"host": "web1.example.com", "dc": "ams", "tag_env": "prod", "request_id": "123"}
+
+	tests := []struct {
+		name     string
+		rules    []*Rule
+		key      string            // The resulting key, of a metric with key cpu
+		metadata map[string]string // nil if the metric is dropped
+	}{
+		{
+			"keep on key",
+			[]*Rule{{Action: ActionKeep, SourceLabels: []string{KeyLabel}, Match: "cpu.*"}},
+			"cpu", metadata,
+		},
+		{
+			"keep on key without match",
+			[]*Rule{{Action: ActionKeep, SourceLabels: []string{KeyLabel}, Match: "mem.*"}},
+			"cpu", nil,
+		},
+		{
+			"keep on key and metadata",
+			[]*Rule{{Action: ActionKeep, SourceLabels: []string{KeyLabel, "dc"}, Match: "cpu;ams"}},
+			"cpu", metadata,
+		},
+		{
+			"keep on key and metadata without match",
+			[]*Rule{{Action: ActionKeep, SourceLabels: []string{KeyLabel, "dc"}, Match: "cpu;fra"}},
+			"cpu", nil,
+		},
+		{
+			"keep is anchored",
+			[]*Rule{{Action: ActionKeep, SourceLabels: []string{"dc"}, Match: "am"}},
+			"cpu", nil,
+		},
+		{
+			"drop on metadata",
+			[]*Rule{{Action: ActionDrop, SourceLabels: []string{"dc"}, Match: "ams|fra"}},
+			"cpu", nil,
+		},
+		{
+			"drop on key and metadata without match",
+			[]*Rule{{Action: ActionDrop, SourceLabels: []string{KeyLabel, "dc"}, Separator: "/", Match: "mem/ams"}},
+			"cpu", metadata,
+		},
+		{
+			"replace metadata",
+			[]*Rule{{SourceLabels: []string{"host"}, Match: `([^.]+)\..*`, TargetLabel: "short"}},
+			"cpu",
+			map[string]string{"host": "web1.example.com", "dc": "ams", "tag_env": "prod", "request_id": "123", "short": "web1"},
+		},
+		{
+			"replace key",
+			[]*Rule{{SourceLabels: []string{"dc", KeyLabel}, Match: "(.*);(.*)", TargetLabel: KeyLabel, Replacement: "$1.$2"}},
+			"ams.cpu", metadata,
+		},
+		{
+			"replace without match",
+			[]*Rule{{SourceLabels: []string{"dc"}, Match: "fra", TargetLabel: "dc", Replacement: "frankfurt"}},
+			"cpu", metadata,
+		},
+		{
+			"replace with an empty value",
+			[]*Rule{{SourceLabels: []string{"missing"}, TargetLabel: "request_id"}},
+			"cpu",
+			map[string]string{"host": "web1.example.com", "dc": "ams", "tag_env": "prod"},
+		},
+		{
+			"labelmap",
+			[]*Rule{{Action: ActionLabelMap, Match: "tag_(.*)"}},
+			"cpu",
+			map[string]string{"host": "web1.example.com", "dc": "ams", "tag_env": "prod", "request_id": "123", "env": "prod"},
+		},
+		{
+			"labeldrop",
+			[]*Rule{{Action: ActionLabelDrop, Match: "request_id|tag_.*"}},
+			"cpu",
+			map[string]string{"host": "web1.example.com", "dc": "ams"},
+		},
+		{
+			"labeldrop keeps the key",
+			[]*Rule{{Action: ActionLabelDrop, Match: ".*"}},
+			"cpu", map[string]string{},
+		},
+		{
+			"hashmod",
+			[]*Rule{{Action: ActionHashMod, SourceLabels: []string{"dc"}, Match: ".*", Modulus: 1000, TargetLabel: "shard"}},
+			"cpu",
+			map[string]string{"host": "web1.example.com", "dc": "ams", "tag_env": "prod", "request_id": "123", "shard": "696"},
+		},
+		{
+			"hashmod on key and metadata",
+			[]*Rule{
+				{Action: ActionReplace, SourceLabels: []string{"host"}, Match: `([^.]+)\..*`, TargetLabel: "host"},
+				{Action: ActionHashMod, SourceLabels: []string{KeyLabel, "host"}, Modulus: 4, TargetLabel: "shard"},
+				{Action: ActionKeep, SourceLabels: []string{"shard"}, Match: "3"},
+			},
+			"cpu",
+			map[string]string{"host": "web1", "dc": "ams", "tag_env": "prod", "request_id": "123", "shard": "3"},
+		},
+	}
+
+	for _, test := range tests {
+		p := NewPipeline("test", newRules(t, test.rules...))
+		m := p.relabel(storage.NewMetric("cpu", storage.FloatValue(1), time.Unix(1500000000, 0), metadata, ""))
+
+		if test.metadata == nil {
+			if m != nil {
+				t.Errorf("%s: expected the metric to be dropped", test.name)
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%s: expected the metric to be kept", test.name)
+			continue
+		}
+
+		if m.Key() != test.key {
+			t.Errorf("%s: expected key %s, got %s", test.name, test.key, m.Key())
+		}
+		if !reflect.DeepEqual(m.Metadata(), test.metadata) {
+			t.Errorf("%s: expected metadata %v, got %v", test.name, test.metadata, m.Metadata())
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule *Rule
+		err  string
+	}{
+		{&Rule{Action: "rewrite"}, "Unknown action: rewrite"},
+		{&Rule{Match: "("}, "Could not parse regex (: error parsing regexp: missing closing ): `^(?:()$`"},
+		{&Rule{SourceLabels: []string{"host"}}, "Action replace requires a target-label"},
+		{&Rule{Action: ActionHashMod, TargetLabel: "shard"}, "Action hashmod requires a modulus"},
+		{&Rule{Action: ActionKeep}, "Action keep requires at least one source-label"},
+	}
+
+	for _, test := range tests {
+		err := test.rule.Validate()
+		if err == nil {
+			t.Errorf("%+v: expected error '%s', got none", test.rule, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%+v: expected error '%s', got '%s'", test.rule, test.err, err.Error())
+		}
+	}
+}
+
+func TestGetOrderedRules(t *testing.T) {
+	rules := GetOrderedRules(map[string]*Rule{
+		"c": {Order: 10},
+		"b": {Order: 20},
+		"a": {Order: 10},
+	})
+
+	ids := make([]string, len(rules))
+	for i, rule := range rules {
+		ids[i] = rule.Id
+	}
+	if !reflect.DeepEqual(ids, []string{"a", "c", "b"}) {
+		t.Errorf("Expected the rules in order a, c, b, got %v", ids)
+	}
+}
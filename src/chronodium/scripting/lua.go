@@ -0,0 +1,328 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scripting
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chronodium/storage"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// The number of goroutines (each with their own interpreter) per source
+const WORKERS = 4
+
+const errorReportInterval = 1 * time.Minute
+
+// The function a script must define. It is called with a table holding the
+// key, value, type (float, integer, boolean or string), time (in seconds
+// since the unix epoch) and metadata of every metric. It returns the table,
+// optionally modified, or nil to drop the metric.
+const transformFunction = "transform"
+
+type Config struct {
+	Path    string
+	Timeout int // In milliseconds, per call
+
+	proto *lua.FunctionProto
+}
+
+func (c *Config) Validate() error {
+	if c.Timeout == 0 {
+		c.Timeout = 10
+	}
+
+	var err error
+	c.proto, err = compile(c.Path)
+	return err
+}
+
+func compile(path string) (*lua.FunctionProto, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(file, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return lua.Compile(chunk, path)
+}
+
+// Transformer runs the metrics of a source through a script
+type Transformer struct {
+	name   string
+	config *Config
+
+	lock       sync.RWMutex
+	proto      *lua.FunctionProto
+	generation uint64
+
+	errors    uint64
+	lastError atomic.Value
+}
+
+func NewTransformer(name string, config *Config) *Transformer {
+	return &Transformer{
+		name:   name,
+		config: config,
+		proto:  config.proto,
+	}
+}
+
+// Reload recompiles the script, the previous version is kept if it fails to compile
+func (t *Transformer) Reload() error {
+	proto, err := compile(t.config.Path)
+	if err != nil {
+		return fmt.Errorf("Could not reload script of source %s: %s", t.name, err.Error())
+	}
+
+	t.lock.Lock()
+	t.proto = proto
+	t.generation++
+	t.lock.Unlock()
+
+	log.Printf("Reloaded script of source %s", t.name)
+	return nil
+}
+
+func (t *Transformer) getProto() (*lua.FunctionProto, uint64) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.proto, t.generation
+}
+
+func (t *Transformer) Transform(src <-chan storage.Metric) <-chan storage.Metric {
+	out := make(chan storage.Metric, cap(src))
+
+	var wg sync.WaitGroup
+	wg.Add(WORKERS)
+	for i := 0; i < WORKERS; i++ {
+		go func() {
+			t.work(src, out)
+			wg.Done()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	go t.reportErrors()
+	return out
+}
+
+func (t *Transformer) work(src <-chan storage.Metric, out chan<- storage.Metric) {
+	var state *interpreter
+	for m := range src {
+		proto, generation := t.getProto()
+		if state == nil || state.generation != generation {
+			if state != nil {
+				state.Close()
+			}
+
+			var err error
+			if state, err = newInterpreter(proto, generation); err != nil {
+				t.recordError(err)
+				state = nil
+				out <- m
+				continue
+			}
+		}
+
+		transformed, err := state.transform(m, time.Duration(t.config.Timeout)*time.Millisecond)
+		if err != nil {
+			// Keep the metric as is
+			t.recordError(err)
+			out <- m
+			continue
+		}
+
+		if transformed != nil {
+			out <- transformed
+		}
+	}
+
+	if state != nil {
+		state.Close()
+	}
+}
+
+func (t *Transformer) recordError(err error) {
+	atomic.AddUint64(&t.errors, 1)
+	t.lastError.Store(err.Error())
+}
+
+func (t *Transformer) reportErrors() {
+	ticker := time.NewTicker(errorReportInterval)
+	for range ticker.C {
+		if errors := atomic.SwapUint64(&t.errors, 0); errors > 0 {
+			log.Printf("Script of source %s failed %d times, last error: %s", t.name, errors, t.lastError.Load())
+		}
+	}
+}
+
+type interpreter struct {
+	*lua.LState
+	generation uint64
+	fn         *lua.LFunction
+}
+
+func newInterpreter(proto *lua.FunctionProto, generation uint64) (*interpreter, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	// Scripts are not supposed to do any I/O
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.TabLibName:    lua.OpenTable,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(open), NRet: 0, Protect: true}, lua.LString(name)); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+
+	// The base library can also load other files
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+
+	fn, ok := L.GetGlobal(transformFunction).(*lua.LFunction)
+	if !ok {
+		L.Close()
+		return nil, fmt.Errorf("Script does not define a function named '%s'", transformFunction)
+	}
+
+	return &interpreter{L, generation, fn}, nil
+}
+
+// transform calls the script for a single metric. Returns nil if the
+// script dropped the metric.
+func (i *interpreter) transform(m storage.Metric, timeout time.Duration) (storage.Metric, error) {
+	value := toLuaValue(m.Value())
+	ts := lua.LNumber(float64(m.Time().UnixNano()) / float64(time.Second))
+
+	metadata := i.NewTable()
+	for k, v := range m.Metadata() {
+		metadata.RawSetString(k, lua.LString(v))
+	}
+
+	tbl := i.NewTable()
+	tbl.RawSetString("key", lua.LString(m.Key()))
+	tbl.RawSetString("value", value)
+	tbl.RawSetString("type", lua.LString(m.Value().Type().String()))
+	tbl.RawSetString("time", ts)
+	tbl.RawSetString("metadata", metadata)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	i.SetContext(ctx)
+	err := i.CallByParam(lua.P{Fn: i.fn, NRet: 1, Protect: true}, tbl)
+	i.RemoveContext()
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := i.Get(-1)
+	i.Pop(1)
+
+	if ret == lua.LNil || ret == lua.LFalse {
+		return nil, nil
+	}
+	result, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("Script returned a %s, expected a table or nil", ret.Type())
+	}
+
+	key := lua.LVAsString(result.RawGetString("key"))
+	if key == "" {
+		return nil, fmt.Errorf("Script returned an empty key")
+	}
+
+	// Only convert values that were changed, as the conversion may lose precision
+	newValue := m.Value()
+	if v, t := result.RawGetString("value"), lua.LVAsString(result.RawGetString("type")); v != value || t != m.Value().Type().String() {
+		if newValue, err = fromLuaValue(v, t); err != nil {
+			return nil, err
+		}
+	}
+
+	newTime := m.Time()
+	if t := result.RawGetString("time"); t != ts {
+		seconds, ok := t.(lua.LNumber)
+		if !ok {
+			return nil, fmt.Errorf("Script returned a time of type %s, expected a number", t.Type())
+		}
+		newTime = time.Unix(0, int64(float64(seconds)*float64(time.Second)))
+	}
+
+	newMetadata := make(map[string]string, 0)
+	if t, ok := result.RawGetString("metadata").(*lua.LTable); ok {
+		t.ForEach(func(k, v lua.LValue) {
+			newMetadata[lua.LVAsString(k)] = lua.LVAsString(v)
+		})
+	}
+
+	return storage.NewMetric(key, newValue, newTime, newMetadata, m.TierSet()), nil
+}
+
+func toLuaValue(value storage.Value) lua.LValue {
+	switch value.Type() {
+	case storage.BooleanType:
+		return lua.LBool(value.Boolean())
+	case storage.StringType:
+		return lua.LString(value.String())
+	}
+
+	return lua.LNumber(value.Float())
+}
+
+func fromLuaValue(value lua.LValue, valueType string) (storage.Value, error) {
+	switch v := value.(type) {
+	case lua.LNumber:
+		if valueType == storage.IntegerType.String() {
+			return storage.IntegerValue(int64(v)), nil
+		}
+		return storage.FloatValue(float64(v)), nil
+	case lua.LBool:
+		return storage.BooleanValue(bool(v)), nil
+	case lua.LString:
+		return storage.StringValue(string(v)), nil
+	}
+
+	return storage.Value{}, fmt.Errorf("Script returned a value of type %s", value.Type())
+}
@@ -0,0 +1,174 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package scripting
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chronodium/storage"
+)
+
+func writeScript(t *testing.T, path, source string) {
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("Could not write script: %s", err.Error())
+	}
+}
+
+func newConfig(t *testing.T, source string) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "chronodium-script")
+	if err != nil {
+		t.Fatalf("Could not create directory: %s", err.Error())
+	}
+
+	config := &Config{Path: filepath.Join(dir, "transform.lua")}
+	writeScript(t, config.Path, source)
+	if err := config.Validate(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not compile script: %s", err.Error())
+	}
+
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func TestTransform(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	metadata := map[string]string{"host": "web1", "env": "prod"}
+
+	tests := []struct {
+		name   string
+		script string
+		out    storage.Metric // nil if the metric is dropped
+		err    string
+	}{
+		{
+			"unchanged",
+			"function transform(m) return m end",
+			storage.NewMetric("cpu", storage.FloatValue(1.5), ts, metadata, "short"), "",
+		},
+		{
+			"drop",
+			"function transform(m) if m.metadata.env == 'prod' then return nil end return m end",
+			nil, "",
+		},
+		{
+			"rewrite key and metadata",
+			`function transform(m)
+				m.key = m.metadata.host .. '.' .. m.key
+				m.metadata.host = nil
+				m.metadata.dc = 'ams'
+				return m
+			end`,
+			storage.NewMetric("web1.cpu", storage.FloatValue(1.5), ts, map[string]string{"env": "prod", "dc": "ams"}, "short"), "",
+		},
+		{
+			"scale value",
+			"function transform(m) m.value = m.value * 100 return m end",
+			storage.NewMetric("cpu", storage.FloatValue(150), ts, metadata, "short"), "",
+		},
+		{
+			"change type",
+			"function transform(m) m.value = 2 m.type = 'integer' return m end",
+			storage.NewMetric("cpu", storage.IntegerValue(2), ts, metadata, "short"), "",
+		},
+		{
+			"change time",
+			"function transform(m) m.time = m.time + 60 return m end",
+			storage.NewMetric("cpu", storage.FloatValue(1.5), ts.Add(time.Minute), metadata, "short"), "",
+		},
+		{
+			"empty key",
+			"function transform(m) m.key = '' return m end",
+			nil, "Script returned an empty key",
+		},
+		{
+			"not a table",
+			"function transform(m) return 1 end",
+			nil, "Script returned a number, expected a table or nil",
+		},
+		{
+			"infinite loop",
+			"function transform(m) while true do end end",
+			nil, "context deadline exceeded",
+		},
+		{
+			"file access",
+			"function transform(m) dofile('/etc/passwd') return m end",
+			nil, "attempt to call a non-function object",
+		},
+	}
+
+	for _, test := range tests {
+		config, cleanup := newConfig(t, test.script)
+		state, err := newInterpreter(config.proto, 0)
+		if err != nil {
+			cleanup()
+			t.Fatalf("%s: unexpected error: %s", test.name, err.Error())
+		}
+
+		in := storage.NewMetric("cpu", storage.FloatValue(1.5), ts, map[string]string{"host": "web1", "env": "prod"}, "short")
+		out, err := state.transform(in, 10*time.Millisecond)
+		state.Close()
+		cleanup()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error '%s', got %v", test.name, test.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.out, out)
+		}
+	}
+}
+
+func TestReloadKeepsPreviousScript(t *testing.T) {
+	config, cleanup := newConfig(t, "function transform(m) m.key = 'first' return m end")
+	defer cleanup()
+
+	transformer := NewTransformer("test", config)
+	writeScript(t, config.Path, "function transform(m) m.key = 'second' return m")
+	if err := transformer.Reload(); err == nil {
+		t.Fatalf("Expected reloading a broken script to fail")
+	}
+
+	src := make(chan storage.Metric, 1)
+	out := transformer.Transform(src)
+	src <- storage.NewMetric("cpu", storage.FloatValue(1), time.Now(), nil, "")
+	close(src)
+
+	if m := <-out; m == nil || m.Key() != "first" {
+		t.Errorf("Expected the previous script to be used, got %+v", m)
+	}
+
+	writeScript(t, config.Path, "function transform(m) m.key = 'second' return m end")
+	if err := transformer.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, generation := transformer.getProto(); generation != 1 {
+		t.Errorf("Expected generation 1, got %d", generation)
+	}
+}
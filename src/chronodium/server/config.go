@@ -20,6 +20,8 @@ import (
 
 	"chronodium/protocol/graphite"
 	"chronodium/protocol/influxdb"
+	"chronodium/relabel"
+	"chronodium/scripting"
 	"chronodium/server/tier"
 	"chronodium/storage/redis"
 )
@@ -29,6 +31,13 @@ type Config struct {
 	Influxdb influxdb.Config
 	Redis    redis.Config
 
+	InfluxdbDatabases map[string]*influxdb.Database `gcfg:"influxdb-database"`
+
+	Scripts map[string]*scripting.Config `gcfg:"script"` // By source name
+
+	UnorderedRelabelRules map[string]*relabel.Rule `gcfg:"relabel"`
+	RelabelRules          []*relabel.Rule
+
 	Tiers            map[string]*tier.Tier    `gcfg:"tier"`
 	UnorderedTierSet map[string]*tier.TierSet `gcfg:"tier-set"`
 	TierSets         []*tier.TierSet
@@ -39,6 +48,27 @@ func NewConfig() *Config {
 }
 
 func (c *Config) Validate() error {
+	if err := c.Graphite.Validate(); err != nil {
+		return fmt.Errorf("Error parsing Graphite config: %s", err.Error())
+	}
+
+	for k, v := range c.Scripts {
+		if k != "graphite" && k != "influxdb" {
+			return fmt.Errorf("Error parsing Script '%s': Unknown source", k)
+		}
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("Error parsing Script '%s': %s", k, err.Error())
+		}
+	}
+
+	for k, v := range c.UnorderedRelabelRules {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("Error parsing Relabel Rule '%s': %s", k, err.Error())
+		}
+	}
+
+	c.RelabelRules = relabel.GetOrderedRules(c.UnorderedRelabelRules)
+
 	for k, v := range c.Tiers {
 		if err := v.Validate(); err != nil {
 			return fmt.Errorf("Error parsing Tier '%s': %s", k, err.Error())
@@ -53,5 +83,9 @@ func (c *Config) Validate() error {
 
 	c.TierSets = tier.GetOrderedTierSets(c.UnorderedTierSet)
 
+	if err := c.Influxdb.Validate(c.InfluxdbDatabases, c.UnorderedTierSet); err != nil {
+		return fmt.Errorf("Error parsing InfluxDB config: %s", err.Error())
+	}
+
 	return nil
 }
@@ -16,9 +16,13 @@
 package server
 
 import (
+	"log"
+
 	"chronodium/protocol/graphite"
 	"chronodium/protocol/http"
 	"chronodium/protocol/influxdb"
+	"chronodium/relabel"
+	"chronodium/scripting"
 	"chronodium/storage"
 	"chronodium/storage/redis"
 	"chronodium/util/stop"
@@ -28,7 +32,8 @@ type Server struct {
 	config  *Config
 	stopper *stop.Stopper
 
-	repo *redis.Redis
+	repo         *redis.Redis
+	transformers []*scripting.Transformer
 }
 
 func NewServer(config *Config, stopper *stop.Stopper) *Server {
@@ -46,7 +51,7 @@ func (s *Server) Start() error {
 		if err := graphite.Start(); err != nil {
 			return err
 		}
-		s.repo.AddSource("graphite", graphite.Metrics())
+		s.addSource("graphite", graphite.Metrics())
 	}
 
 	if s.config.Influxdb.Enable {
@@ -55,7 +60,7 @@ func (s *Server) Start() error {
 			return err
 		}
 
-		s.repo.AddSource("influxdb", influxdb.Metrics())
+		s.addSource("influxdb", influxdb.Metrics())
 	}
 	s.repo.Start()
 
@@ -64,6 +69,32 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// addSource passes the metrics of a source through its script, if any,
+// and then through the relabel rules.
+func (s *Server) addSource(name string, metrics <-chan storage.Metric) {
+	if config, ok := s.config.Scripts[name]; ok {
+		transformer := scripting.NewTransformer(name, config)
+		s.transformers = append(s.transformers, transformer)
+		metrics = transformer.Transform(metrics)
+	}
+
+	if len(s.config.RelabelRules) > 0 {
+		metrics = relabel.NewPipeline(name, s.config.RelabelRules).Process(metrics)
+	}
+
+	s.repo.AddSource(name, metrics)
+}
+
+// Reload reloads all scripts. Scripts that fail to compile are reported,
+// and the previous version is kept.
+func (s *Server) Reload() {
+	for _, transformer := range s.transformers {
+		if err := transformer.Reload(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
 func (s *Server) Repo() storage.Repo {
 	return s.repo
 }
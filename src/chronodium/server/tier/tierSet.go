@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"time"
 )
 
 type orderableTierSet []*TierSet
@@ -64,6 +65,19 @@ func (t *TierSet) Validate(tiers map[string]*Tier) error {
 	return nil
 }
 
+// Retention returns how long the points of the tier set are kept, which is
+// the TTL of its longest lasting tier.
+func (t *TierSet) Retention() time.Duration {
+	out := time.Duration(0)
+	for _, tier := range t.Tiers {
+		if tier.ttl > out {
+			out = tier.ttl
+		}
+	}
+
+	return out
+}
+
 func GetOrderedTierSets(tiers map[string]*TierSet) []*TierSet {
 	out := make([]*TierSet, len(tiers))
 	i := 0
@@ -77,6 +91,29 @@ func GetOrderedTierSets(tiers map[string]*TierSet) []*TierSet {
 	return out
 }
 
+// GetTierSetForKey returns the first of the (ordered) tier sets that matches
+// the given metric key, or nil if none does.
+func GetTierSetForKey(tierSets []*TierSet, key string) *TierSet {
+	for _, tierSet := range tierSets {
+		if tierSet.Regex.MatchString(key) {
+			return tierSet
+		}
+	}
+
+	return nil
+}
+
+// GetTierSet returns the tier set with the given id, or nil if there is none.
+func GetTierSet(tierSets []*TierSet, id string) *TierSet {
+	for _, tierSet := range tierSets {
+		if tierSet.Id == id {
+			return tierSet
+		}
+	}
+
+	return nil
+}
+
 func (s orderableTierSet) Len() int {
 	return len(s)
 }
@@ -0,0 +1,369 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// A backup archive is a gzip compressed stream. It starts with the magic
+// string, the archive version and the schema version of the keys it
+// contains, followed by any number of records. All integers are big endian.
+//
+// Every record starts with its type (1 byte), the key (uint16 length, bytes)
+// and the time the key expires in milliseconds since the epoch (int64, zero
+// meaning never).
+//
+// Series records are followed by the raw points (uint32 length, bytes).
+// Index records are followed by the number of members (uint32) and per
+// member its score (float64 bits as uint64) and value (uint32 length, bytes).
+//
+// The archive ends with a record of type recordEnd, which has no key.
+const (
+	backupMagic   = "CHRONODIUM-BACKUP"
+	backupVersion = 1
+
+	recordEnd    = byte(0)
+	recordSeries = byte(1)
+	recordIndex  = byte(2)
+
+	// The maximum length of a value in an archive, which is the maximum
+	// size of a string in Redis
+	maxBackupValueLength = 512 << 20
+)
+
+type BackupOptions struct {
+	Pattern   string // Glob pattern the metric keys must match
+	StartDate time.Time
+	EndDate   time.Time
+}
+
+// Backup writes all series and indexes in buckets that overlap with the
+// given time range to w. A zero start or end date leaves that side of the
+// time range unbounded. Returns the number of keys written.
+func (r *Redis) Backup(w io.Writer, opts *BackupOptions) (int, error) {
+	gz := gzip.NewWriter(w)
+	archive := bufio.NewWriter(gz)
+
+	archive.WriteString(backupMagic)
+	binary.Write(archive, binary.BigEndian, uint16(backupVersion))
+	binary.Write(archive, binary.BigEndian, uint16(SCHEMA_VERSION))
+
+	pattern := opts.Pattern
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	var lock sync.Mutex
+	written := 0
+	err := r.scanKeys(fmt.Sprintf("chronodium-%d-{metric-%s}-%d-*", SCHEMA_VERSION, pattern, bucketWindow), func(keys []string) error {
+		for _, key := range keys {
+			parsed, ok := parseKey(key)
+			if !ok || parsed.keyType == keyTypeSummary {
+				// Summaries are recreated at query time
+				continue
+			}
+
+			start, end := r.getBucketBounds(parsed.shardKey, parsed.bucket)
+			if (!opts.StartDate.IsZero() && !end.After(opts.StartDate)) ||
+				(!opts.EndDate.IsZero() && start.After(opts.EndDate)) {
+				continue
+			}
+
+			record, err := r.getBackupRecord(key, parsed.keyType == keyTypeIndex)
+			if err == redis.Nil {
+				continue // Expired in the meantime
+			} else if err != nil {
+				return fmt.Errorf("Could not backup %s: %s", key, err.Error())
+			}
+
+			lock.Lock()
+			_, err = archive.Write(record)
+			if err == nil {
+				written++
+			}
+			lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return written, err
+	}
+
+	archive.WriteByte(recordEnd)
+	if err := archive.Flush(); err != nil {
+		return written, err
+	}
+
+	return written, gz.Close()
+}
+
+func (r *Redis) getBackupRecord(key string, isIndex bool) ([]byte, error) {
+	ttl, err := r.client.PTTL(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl == -2*time.Millisecond {
+		return nil, redis.Nil // Key does not exist (anymore)
+	}
+	expiry := int64(0)
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	}
+
+	record := make([]byte, 0, 64)
+	record = append(record, recordSeries)
+	if isIndex {
+		record[0] = recordIndex
+	}
+	record = appendUint16(record, uint16(len(key)))
+	record = append(record, key...)
+	record = appendUint64(record, uint64(expiry))
+
+	if !isIndex {
+		points, err := r.client.Get(key).Bytes()
+		if err != nil {
+			return nil, err
+		}
+
+		record = appendUint32(record, uint32(len(points)))
+		return append(record, points...), nil
+	}
+
+	members, err := r.client.ZRangeWithScores(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	record = appendUint32(record, uint32(len(members)))
+	for _, z := range members {
+		member := z.Member.(string)
+		record = appendUint64(record, math.Float64bits(z.Score))
+		record = appendUint32(record, uint32(len(member)))
+		record = append(record, member...)
+	}
+
+	return record, nil
+}
+
+// Restore writes all keys from a backup archive back into Redis, replacing
+// any existing keys with the same name. Keys that have expired since the
+// backup was made are skipped. Archives holding keys of the previous schema
+// version are converted. Returns the number of keys restored.
+func (r *Redis) Restore(rd io.Reader) (int, error) {
+	gz, err := gzip.NewReader(rd)
+	if err != nil {
+		return 0, fmt.Errorf("Not a valid backup archive: %s", err.Error())
+	}
+	archive := bufio.NewReader(gz)
+
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(archive, magic); err != nil || string(magic) != backupMagic {
+		return 0, fmt.Errorf("Not a valid backup archive")
+	}
+
+	var version, schemaVersion uint16
+	binary.Read(archive, binary.BigEndian, &version)
+	if err := binary.Read(archive, binary.BigEndian, &schemaVersion); err != nil {
+		return 0, fmt.Errorf("Not a valid backup archive: %s", err.Error())
+	}
+	if version != backupVersion {
+		return 0, fmt.Errorf("Unsupported backup archive version %d", version)
+	}
+	if schemaVersion != SCHEMA_VERSION && schemaVersion != LEGACY_SCHEMA_VERSION {
+		return 0, fmt.Errorf("Backup archive contains keys of schema version %d, expected %d", schemaVersion, SCHEMA_VERSION)
+	}
+
+	restored := 0
+	for {
+		recordType, err := archive.ReadByte()
+		if err != nil {
+			return restored, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+		}
+		if recordType == recordEnd {
+			return restored, nil
+		}
+
+		record, err := readRecord(archive, recordType)
+		if err != nil {
+			return restored, err
+		}
+
+		if ok, err := r.restoreRecord(record, int(schemaVersion)); err != nil {
+			return restored, err
+		} else if ok {
+			restored++
+		}
+	}
+}
+
+type backupRecord struct {
+	recordType byte
+	key        string
+	expiry     time.Time // Zero if the key does not expire
+	points     []byte    // Series records only
+	members    []redis.Z // Index records only
+}
+
+// readRecord reads the remainder of a record of the given type
+func readRecord(archive io.Reader, recordType byte) (*backupRecord, error) {
+	var keyLength uint16
+	var expiry int64
+	if err := binary.Read(archive, binary.BigEndian, &keyLength); err != nil {
+		return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+	}
+	key, err := readBytes(archive, int64(keyLength))
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Read(archive, binary.BigEndian, &expiry); err != nil {
+		return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+	}
+
+	record := &backupRecord{recordType: recordType, key: string(key)}
+	if expiry > 0 {
+		record.expiry = time.Unix(0, expiry*int64(time.Millisecond))
+	}
+
+	switch recordType {
+	case recordSeries:
+		var length uint32
+		if err := binary.Read(archive, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+		}
+		if record.points, err = readBytes(archive, int64(length)); err != nil {
+			return nil, err
+		}
+
+	case recordIndex:
+		var count uint32
+		if err := binary.Read(archive, binary.BigEndian, &count); err != nil {
+			return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+		}
+
+		record.members = make([]redis.Z, 0)
+		for i := uint32(0); i < count; i++ {
+			var score uint64
+			var length uint32
+			if err := binary.Read(archive, binary.BigEndian, &score); err != nil {
+				return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+			}
+			if err := binary.Read(archive, binary.BigEndian, &length); err != nil {
+				return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+			}
+			member, err := readBytes(archive, int64(length))
+			if err != nil {
+				return nil, err
+			}
+			record.members = append(record.members, redis.Z{Score: math.Float64frombits(score), Member: string(member)})
+		}
+
+	default:
+		return nil, fmt.Errorf("Backup archive contains an unknown record type %d", recordType)
+	}
+
+	return record, nil
+}
+
+// restoreRecord restores a single record, converting keys of the previous
+// schema version to the current one. Returns false if the key has expired
+// since the backup was made.
+func (r *Redis) restoreRecord(record *backupRecord, schemaVersion int) (bool, error) {
+	parsed, ok := parseKeyOfSchema(record.key, schemaVersion)
+	if !ok || parsed.keyType == keyTypeSummary {
+		return false, fmt.Errorf("Backup archive contains an unknown key: %s", record.key)
+	}
+
+	if !record.expiry.IsZero() && !record.expiry.After(time.Now()) {
+		return false, nil
+	}
+
+	key, points := record.key, record.points
+	if schemaVersion == LEGACY_SCHEMA_VERSION && parsed.keyType == keyTypeData {
+		key = dataKey(parsed.shardKey, parsed.bucket, parsed.metadataHash)
+
+		var err error
+		if points, err = convertLegacyPoints(points); err != nil {
+			return false, fmt.Errorf("Backup archive contains a corrupt series %s: %s", record.key, err.Error())
+		}
+	} else if schemaVersion == LEGACY_SCHEMA_VERSION {
+		key = indexKey(parsed.shardKey, parsed.bucket)
+	}
+
+	if record.recordType == recordSeries && parsed.keyType != keyTypeData ||
+		record.recordType == recordIndex && parsed.keyType != keyTypeIndex {
+		return false, fmt.Errorf("Backup archive contains a record of the wrong type for %s", record.key)
+	}
+	if err := validatePoints(points); err != nil {
+		return false, fmt.Errorf("Backup archive contains a corrupt series %s: %s", record.key, err.Error())
+	}
+
+	r.cache.remove(key)
+	_, err := r.client.Pipelined(func(pipeline *redis.Pipeline) error {
+		pipeline.Del(key)
+		if record.recordType == recordSeries {
+			pipeline.Set(key, string(points), 0)
+		} else if len(record.members) > 0 {
+			pipeline.ZAdd(key, record.members...)
+		}
+		if !record.expiry.IsZero() {
+			pipeline.PExpireAt(key, record.expiry)
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// readBytes reads a value of the given length. The buffer grows as the value
+// is read, so that a corrupt length does not allocate more than is there.
+func readBytes(rd io.Reader, length int64) ([]byte, error) {
+	if length > maxBackupValueLength {
+		return nil, fmt.Errorf("Backup archive is corrupt: value of %d bytes exceeds the maximum of %d", length, maxBackupValueLength)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, rd, length); err != nil {
+		return nil, fmt.Errorf("Backup archive is truncated: %s", err.Error())
+	}
+
+	return buf.Bytes(), nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v>>32)), uint32(v))
+}
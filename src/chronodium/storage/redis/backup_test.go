@@ -0,0 +1,96 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"chronodium/storage"
+
+	"gopkg.in/redis.v5"
+)
+
+func TestReadRecord(t *testing.T) {
+	key := dataKey("cpu", 0, 1)
+	points := encodePoint(1500000000, storage.FloatValue(1))
+
+	buf := appendUint16(nil, uint16(len(key)))
+	buf = append(buf, key...)
+	buf = appendUint64(buf, 1500000000000)
+	buf = appendUint32(buf, uint32(len(points)))
+	buf = append(buf, points...)
+
+	record, err := readRecord(bytes.NewReader(buf), recordSeries)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if record.key != key || !bytes.Equal(record.points, points) || !record.expiry.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("Unexpected record %+v", record)
+	}
+
+	key = indexKey("cpu", 0)
+	buf = appendUint16(nil, uint16(len(key)))
+	buf = append(buf, key...)
+	buf = appendUint64(buf, 0)
+	buf = appendUint32(buf, 1)
+	buf = appendUint64(buf, 0x3ff0000000000000)
+	buf = appendUint32(buf, 4)
+	buf = append(buf, "0-{}"...)
+
+	record, err = readRecord(bytes.NewReader(buf), recordIndex)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !record.expiry.IsZero() || !reflect.DeepEqual(record.members, []redis.Z{{Score: 1, Member: "0-{}"}}) {
+		t.Errorf("Unexpected record %+v", record)
+	}
+}
+
+func TestReadRecordRejects(t *testing.T) {
+	header := appendUint64(append(appendUint16(nil, 1), 'k'), 0)
+
+	tests := []struct {
+		name       string
+		recordType byte
+		data       []byte
+		err        string
+	}{
+		{"truncated key", recordSeries, append(appendUint16(nil, 10), "key"...),
+			"Backup archive is truncated: EOF"},
+		{"truncated points", recordSeries, append(appendUint32(header, 10), "abc"...),
+			"Backup archive is truncated: EOF"},
+		{"huge points", recordSeries, appendUint32(header, 0xffffffff),
+			"Backup archive is corrupt: value of 4294967295 bytes exceeds the maximum of 536870912"},
+		{"huge member", recordIndex, appendUint32(appendUint64(appendUint32(header, 1), 0), 0xffffffff),
+			"Backup archive is corrupt: value of 4294967295 bytes exceeds the maximum of 536870912"},
+		{"missing members", recordIndex, appendUint32(header, 0xffffffff),
+			"Backup archive is truncated: EOF"},
+		{"unknown type", 9, header,
+			"Backup archive contains an unknown record type 9"},
+	}
+
+	for _, test := range tests {
+		_, err := readRecord(bytes.NewReader(test.data), test.recordType)
+		if err == nil {
+			t.Errorf("%s: expected error '%s', got none", test.name, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%s: expected error '%s', got '%s'", test.name, test.err, err.Error())
+		}
+	}
+}
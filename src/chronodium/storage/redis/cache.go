@@ -0,0 +1,211 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// Points may arrive late, a bucket is only considered sealed once
+// this long has passed since the end of its window.
+const bucketSealDelay = 10 * time.Minute
+
+// Rough per entry overhead on top of the cached data
+const cacheEntryOverhead = 128
+
+// The longest an entry is cached. Deletes and restores done through the
+// command line run in another process, and cannot invalidate the cache of
+// a running daemon.
+const cacheEntryTtl = 5 * time.Minute
+
+// bucketCache is an LRU cache of the contents of sealed buckets, keyed by
+// redis key. Entries are evicted when the total size of the cached data
+// exceeds the configured budget, or once their deadline has passed.
+type bucketCache struct {
+	maxSize int64
+
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key      string
+	value    interface{}
+	size     int64
+	deadline time.Time
+}
+
+func newBucketCache(config *Config) *bucketCache {
+	if config.QueryCacheSize <= 0 {
+		return nil
+	}
+
+	return &bucketCache{
+		maxSize: config.QueryCacheSize,
+		entries: make(map[string]*list.Element, 0),
+		lru:     list.New(),
+	}
+}
+
+func (c *bucketCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && time.Now().After(elem.Value.(*cacheEntry).deadline) {
+		c.removeElement(elem)
+		ok = false
+	}
+
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+func (c *bucketCache) add(key string, value interface{}, size int64, deadline time.Time) {
+	if c == nil || size+cacheEntryOverhead > c.maxSize {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, exists := c.entries[key]; exists {
+		c.removeElement(elem)
+	}
+
+	if maxDeadline := time.Now().Add(cacheEntryTtl); deadline.After(maxDeadline) {
+		deadline = maxDeadline
+	}
+	entry := &cacheEntry{key, value, size + cacheEntryOverhead, deadline}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *bucketCache) remove(keys ...string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range keys {
+		if elem, exists := c.entries[key]; exists {
+			c.removeElement(elem)
+		}
+	}
+}
+
+func (c *bucketCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+func (c *bucketCache) stats() map[string]int64 {
+	if c == nil {
+		return map[string]int64{}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return map[string]int64{
+		"cache_hits":    int64(atomic.LoadUint64(&c.hits)),
+		"cache_misses":  int64(atomic.LoadUint64(&c.misses)),
+		"cache_entries": int64(len(c.entries)),
+		"cache_bytes":   c.size,
+	}
+}
+
+// isSealed reports whether no more points are expected for the bucket
+func (r *Redis) isSealed(shardKey string, bucket int) bool {
+	_, end := r.getBucketBounds(shardKey, bucket)
+	return time.Now().After(end.Add(bucketSealDelay))
+}
+
+// getIndex returns the members of the index of a bucket, from the cache
+// if the bucket has been sealed.
+func (r *Redis) getIndex(shardKey string, bucket int) ([]redis.Z, error) {
+	redisKey := indexKey(shardKey, bucket)
+	sealed := r.isSealed(shardKey, bucket)
+	if sealed {
+		if members, ok := r.cache.get(redisKey); ok {
+			return members.([]redis.Z), nil
+		}
+	}
+
+	members, err := r.client.ZRangeWithScores(redisKey, 0, -1).Result()
+	if err != nil || !sealed {
+		return members, err
+	}
+
+	size := int64(0)
+	for _, z := range members {
+		size += int64(len(z.Member.(string))) + 8
+	}
+	r.cache.add(redisKey, members, size, r.getExpiry(shardKey, bucket))
+
+	return members, nil
+}
+
+// getRawPoints returns the packed points of a series, from the cache
+// if the bucket has been sealed.
+func (r *Redis) getRawPoints(shardKey string, bucket int, metadataHash uint32) ([]byte, error) {
+	redisKey := dataKey(shardKey, bucket, metadataHash)
+	sealed := r.isSealed(shardKey, bucket)
+	if sealed {
+		if rawPoints, ok := r.cache.get(redisKey); ok {
+			return rawPoints.([]byte), nil
+		}
+	}
+
+	rawPoints, err := r.client.Get(redisKey).Bytes()
+	if err == redis.Nil {
+		// Series of a shorter retention expire before the index of their bucket
+		return nil, nil
+	}
+	if err != nil || !sealed {
+		return rawPoints, err
+	}
+
+	r.cache.add(redisKey, rawPoints, int64(len(rawPoints)), r.getExpiry(shardKey, bucket))
+	return rawPoints, nil
+}
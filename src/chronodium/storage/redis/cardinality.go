@@ -0,0 +1,144 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const cardinalityReportInterval = 1 * time.Minute
+
+// cardinalityLimiter keeps track of the distinct metadata sets (series) that
+// were written per metric key and bucket, and rejects points that would
+// create new series beyond the configured limits.
+//
+// Series are tracked in memory only, series that were created before a
+// restart do not count towards the limits.
+type cardinalityLimiter struct {
+	maxPerMetric int
+	maxTotal     int
+
+	lock     sync.Mutex
+	buckets  map[string]*bucketSeries // by index key
+	series   map[seriesId]int         // the number of buckets holding a series
+	rejected map[string]int           // by metric key, since the last report
+
+	rejectedTotal uint64
+}
+
+type bucketSeries struct {
+	shardKey string
+	hashes   map[uint32]struct{}
+	lastSeen time.Time
+}
+
+// seriesId identifies a series regardless of bucket, as series usually
+// span multiple buckets.
+type seriesId struct {
+	shardKey     string
+	metadataHash uint32
+}
+
+func newCardinalityLimiter(config *Config) *cardinalityLimiter {
+	if config.MaxSeriesPerMetric <= 0 && config.MaxSeries <= 0 {
+		return nil
+	}
+
+	return &cardinalityLimiter{
+		maxPerMetric: config.MaxSeriesPerMetric,
+		maxTotal:     config.MaxSeries,
+		buckets:      make(map[string]*bucketSeries, 0),
+		series:       make(map[seriesId]int, 0),
+		rejected:     make(map[string]int, 0),
+	}
+}
+
+// allow reports whether a point of the given series may be stored
+func (l *cardinalityLimiter) allow(shardKey string, bucket int, metadataHash uint32) bool {
+	if l == nil {
+		return true
+	}
+
+	redisKey := indexKey(shardKey, bucket)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	series, ok := l.buckets[redisKey]
+	if !ok {
+		series = &bucketSeries{shardKey: shardKey, hashes: make(map[uint32]struct{}, 0)}
+		l.buckets[redisKey] = series
+	}
+	series.lastSeen = time.Now()
+
+	if _, exists := series.hashes[metadataHash]; exists {
+		return true
+	}
+
+	// A series that continues in a new bucket is not a new series in total
+	id := seriesId{shardKey, metadataHash}
+	if (l.maxPerMetric > 0 && len(series.hashes) >= l.maxPerMetric) ||
+		(l.maxTotal > 0 && l.series[id] == 0 && len(l.series) >= l.maxTotal) {
+		l.rejected[shardKey]++
+		atomic.AddUint64(&l.rejectedTotal, 1)
+		return false
+	}
+
+	series.hashes[metadataHash] = struct{}{}
+	l.series[id]++
+	return true
+}
+
+// RejectedTotal returns the number of points that were rejected since startup
+func (l *cardinalityLimiter) RejectedTotal() uint64 {
+	if l == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&l.rejectedTotal)
+}
+
+// monitor periodically reports the rejected metrics and forgets about
+// buckets that are no longer written to.
+func (l *cardinalityLimiter) monitor() {
+	ticker := time.NewTicker(cardinalityReportInterval)
+	for range ticker.C {
+		l.lock.Lock()
+		for shardKey, count := range l.rejected {
+			log.Printf("Rejected %d points of metric '%s' because the series limit was reached", count, shardKey)
+		}
+		l.rejected = make(map[string]int, 0)
+
+		expired := time.Now().Add(-1 * bucketWindow * time.Second)
+		for redisKey, series := range l.buckets {
+			if !series.lastSeen.Before(expired) {
+				continue
+			}
+
+			for hash := range series.hashes {
+				id := seriesId{series.shardKey, hash}
+				if l.series[id]--; l.series[id] == 0 {
+					delete(l.series, id)
+				}
+			}
+			delete(l.buckets, redisKey)
+		}
+		l.lock.Unlock()
+	}
+}
@@ -0,0 +1,187 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"chronodium/storage"
+
+	"gopkg.in/redis.v5"
+)
+
+func (r *Redis) Delete(query *storage.Query) (int, error) {
+	if query.ShardKey == "" {
+		return 0, fmt.Errorf("No primary key specified")
+	}
+
+	buckets, err := r.getBucketsToDelete(query)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	seen := make(map[int]bool, len(buckets))
+	for _, bucket := range buckets {
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+
+		n, err := r.deleteFromBucket(query, bucket)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+func (r *Redis) getBucketsToDelete(query *storage.Query) ([]int, error) {
+	if !query.StartDate.IsZero() && !query.EndDate.IsZero() {
+		return r.getBucketsInWindow(query.GetStartDate(), query.GetEndDate(), query.ShardKey)
+	}
+
+	// Without a bounded time range there is no telling which buckets
+	// exist, so we have to look them up.
+	return r.getStoredBuckets(query.ShardKey)
+}
+
+// getStoredBuckets returns all buckets for which an index exists
+func (r *Redis) getStoredBuckets(shardKey string) ([]int, error) {
+	pattern := fmt.Sprintf("%s-%d-*-raw", escapeGlob(metricKeyPrefix(shardKey)), bucketWindow)
+
+	var mu sync.Mutex
+	buckets := make([]int, 0)
+	err := r.scanKeys(pattern, func(keys []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, key := range keys {
+			parsed, ok := parseKey(key)
+			if !ok || parsed.shardKey != shardKey {
+				// Belongs to a different metric key that happens to share our prefix
+				continue
+			}
+			buckets = append(buckets, parsed.bucket)
+		}
+		return nil
+	})
+
+	return buckets, err
+}
+
+// Rewrites a series, provided it still starts with the points it was read
+// with. Points appended in the meantime are retained. Series that end up
+// empty are removed from the index altogether.
+//
+// KEYS: data key, index key, summary key
+// ARGV: points read, points to retain, metadata hash
+const rewriteSeriesScript = `
+local current = redis.call('GET', KEYS[1]) or ''
+if string.sub(current, 1, #ARGV[1]) ~= ARGV[1] then
+	return 0
+end
+
+local retained = ARGV[2] .. string.sub(current, #ARGV[1] + 1)
+if retained == '' then
+	redis.call('DEL', KEYS[1])
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], ARGV[3], ARGV[3])
+else
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl > 0 then
+		redis.call('SET', KEYS[1], retained, 'PX', ttl)
+	else
+		redis.call('SET', KEYS[1], retained)
+	end
+end
+
+-- The summary is recreated at query time
+redis.call('HDEL', KEYS[3], ARGV[3])
+return 1
+`
+
+// How often a series is read again when it was rewritten by someone else
+// while points were being deleted from it
+const deleteAttempts = 10
+
+// deleteFromBucket removes the matching points from all series in a bucket
+// that match the filter of the query.
+func (r *Redis) deleteFromBucket(query *storage.Query, bucket int) (int, error) {
+	hashes, err := r.getFilteredMetadataHashes(query.ShardKey, bucket, query.Filter)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for hash := range hashes {
+		n, err := r.deleteFromSeries(query, bucket, hash)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// deleteFromSeries removes the matching points from a single series. The
+// points are filtered client side, and written back atomically.
+func (r *Redis) deleteFromSeries(query *storage.Query, bucket int, hash uint32) (int, error) {
+	redisKey := dataKey(query.ShardKey, bucket, hash)
+	keys := []string{redisKey, indexKey(query.ShardKey, bucket), summaryKey(query.ShardKey, bucket)}
+	field := strconv.FormatUint(uint64(hash), 10)
+
+	for attempt := 0; attempt < deleteAttempts; attempt++ {
+		rawPoints, err := r.client.Get(redisKey).Bytes()
+		if err != nil && err != redis.Nil {
+			return 0, err
+		}
+
+		// Refuse to rewrite a corrupt series, as that would lose the truncated record
+		if err := validatePoints(rawPoints); err != nil {
+			return 0, fmt.Errorf("Could not delete from %s: %s", redisKey, err.Error())
+		}
+
+		deleted := 0
+		retained := make([]byte, 0, len(rawPoints))
+		decodePoints(rawPoints, func(timestamp int64, value storage.Value) {
+			if query.Contains(timestamp) {
+				deleted++
+				return
+			}
+			retained = append(retained, encodePoint(timestamp, value)...)
+		})
+
+		if len(retained) == len(rawPoints) && len(rawPoints) != 0 {
+			return 0, nil
+		}
+
+		res, err := r.client.Eval(rewriteSeriesScript, keys, string(rawPoints), string(retained), field).Result()
+		if err != nil {
+			return 0, err
+		}
+		if rewritten, _ := res.(int64); rewritten == 1 {
+			r.cache.remove(keys[0], keys[1])
+			return deleted, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Could not delete from %s: it was rewritten concurrently", redisKey)
+}
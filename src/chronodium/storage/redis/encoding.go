@@ -0,0 +1,169 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"chronodium/storage"
+	"chronodium/util/conversion"
+)
+
+// The points of a series are stored as a concatenation of records. Every
+// record consists of the timestamp in nanoseconds since the unix epoch
+// (int64), the type of the value (uint8, see storage.ValueType) and the
+// value. Floats (IEEE 754 float64) and integers (int64) take 8 bytes,
+// booleans a single byte, and strings are prefixed by their length
+// (uint32). Everything is encoded little endian regardless of the byte
+// order of the host.
+const pointHeaderSize = 9
+
+func encodePoint(timestamp int64, value storage.Value) []byte {
+	var buf []byte
+	switch value.Type() {
+	case storage.FloatType:
+		buf = make([]byte, pointHeaderSize+8)
+		conversion.Float64ToBinary(buf[pointHeaderSize:], value.Float())
+	case storage.IntegerType:
+		buf = make([]byte, pointHeaderSize+8)
+		conversion.Int64ToBinary(buf[pointHeaderSize:], value.Integer())
+	case storage.BooleanType:
+		buf = make([]byte, pointHeaderSize+1)
+		if value.Boolean() {
+			buf[pointHeaderSize] = 1
+		}
+	case storage.StringType:
+		str := value.String()
+		buf = make([]byte, pointHeaderSize+4+len(str))
+		binary.LittleEndian.PutUint32(buf[pointHeaderSize:], uint32(len(str)))
+		copy(buf[pointHeaderSize+4:], str)
+	default:
+		panic(fmt.Sprintf("Unsupported value type %d", value.Type()))
+	}
+
+	conversion.Int64ToBinary(buf[0:8], timestamp)
+	buf[8] = byte(value.Type())
+	return buf
+}
+
+// decodePoint decodes the record at the start of rawPoints, and returns
+// its size. An error is returned if the record is truncated or invalid.
+func decodePoint(rawPoints []byte) (timestamp int64, value storage.Value, size int, err error) {
+	if len(rawPoints) < pointHeaderSize {
+		return 0, value, 0, fmt.Errorf("Found a truncated record of %d bytes", len(rawPoints))
+	}
+
+	timestamp = conversion.BinaryToInt64(rawPoints[0:8])
+	payload := rawPoints[pointHeaderSize:]
+	switch storage.ValueType(rawPoints[8]) {
+	case storage.FloatType:
+		if size = 8; len(payload) >= size {
+			value = storage.FloatValue(conversion.BinaryToFloat64(payload))
+		}
+	case storage.IntegerType:
+		if size = 8; len(payload) >= size {
+			value = storage.IntegerValue(conversion.BinaryToInt64(payload))
+		}
+	case storage.BooleanType:
+		if size = 1; len(payload) >= size {
+			value = storage.BooleanValue(payload[0] != 0)
+		}
+	case storage.StringType:
+		if size = 4; len(payload) >= size {
+			size += int(binary.LittleEndian.Uint32(payload))
+			if len(payload) >= size {
+				value = storage.StringValue(string(payload[4:size]))
+			}
+		}
+	default:
+		return 0, value, 0, fmt.Errorf("Found a record of unknown type %d", rawPoints[8])
+	}
+
+	if len(payload) < size {
+		return 0, value, 0, fmt.Errorf("Found a truncated record of %d bytes", len(rawPoints))
+	}
+
+	return timestamp, value, pointHeaderSize + size, nil
+}
+
+// Schema version 1 stored floats only, as records of 16 bytes: the
+// timestamp followed by the value.
+const legacyPointSize = 16
+
+// convertLegacyPoints converts points of schema version 1 to the current
+// encoding. An error is returned if rawPoints ends with a truncated record.
+func convertLegacyPoints(rawPoints []byte) ([]byte, error) {
+	if trailing := len(rawPoints) % legacyPointSize; trailing != 0 {
+		return nil, fmt.Errorf("Found a truncated record of %d bytes after %d points",
+			trailing, len(rawPoints)/legacyPointSize)
+	}
+
+	out := make([]byte, 0, len(rawPoints)/legacyPointSize*(pointHeaderSize+8))
+	for i := 0; i < len(rawPoints); i += legacyPointSize {
+		value := storage.FloatValue(conversion.BinaryToFloat64(rawPoints[i+8 : i+16]))
+		out = append(out, encodePoint(conversion.BinaryToInt64(rawPoints[i:i+8]), value)...)
+	}
+
+	return out, nil
+}
+
+// validatePoints checks whether rawPoints consists of complete records only
+func validatePoints(rawPoints []byte) error {
+	return decodePoints(rawPoints, func(int64, storage.Value) {})
+}
+
+// decodePoints calls fn for every record in rawPoints. An error is returned
+// if rawPoints ends with a truncated record, or contains an invalid one.
+func decodePoints(rawPoints []byte, fn func(timestamp int64, value storage.Value)) error {
+	count := 0
+	for i := 0; i < len(rawPoints); count++ {
+		timestamp, value, size, err := decodePoint(rawPoints[i:])
+		if err != nil {
+			return fmt.Errorf("%s after %d points", err.Error(), count)
+		}
+
+		fn(timestamp, value)
+		i += size
+	}
+
+	return nil
+}
+
+// Summaries are stored as a single record of 48 bytes: the number of
+// points (int64), the minimum, maximum and sum of the values (float64)
+// and the timestamps of the first and last point (int64).
+const summarySize = 48
+
+func encodeSummary(buf []byte, s *summary) {
+	conversion.Int64ToBinary(buf[0:8], s.count)
+	conversion.Float64ToBinary(buf[8:16], s.min)
+	conversion.Float64ToBinary(buf[16:24], s.max)
+	conversion.Float64ToBinary(buf[24:32], s.sum)
+	conversion.Int64ToBinary(buf[32:40], s.first)
+	conversion.Int64ToBinary(buf[40:48], s.last)
+}
+
+func decodeSummary(buf []byte) *summary {
+	return &summary{
+		count: conversion.BinaryToInt64(buf[0:8]),
+		min:   conversion.BinaryToFloat64(buf[8:16]),
+		max:   conversion.BinaryToFloat64(buf[16:24]),
+		sum:   conversion.BinaryToFloat64(buf[24:32]),
+		first: conversion.BinaryToInt64(buf[32:40]),
+		last:  conversion.BinaryToInt64(buf[40:48]),
+	}
+}
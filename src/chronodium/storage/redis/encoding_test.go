@@ -0,0 +1,160 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chronodium/storage"
+	"chronodium/util/conversion"
+)
+
+type decodedPoint struct {
+	timestamp int64
+	value     storage.Value
+}
+
+func decodeAll(rawPoints []byte) ([]decodedPoint, error) {
+	var out []decodedPoint
+	err := decodePoints(rawPoints, func(timestamp int64, value storage.Value) {
+		out = append(out, decodedPoint{timestamp, value})
+	})
+	return out, err
+}
+
+func TestEncodePoint(t *testing.T) {
+	tests := []struct {
+		value storage.Value
+		size  int
+	}{
+		{storage.FloatValue(1.5), pointHeaderSize + 8},
+		{storage.FloatValue(math.Inf(-1)), pointHeaderSize + 8},
+		{storage.IntegerValue(-42), pointHeaderSize + 8},
+		{storage.IntegerValue(math.MaxInt64), pointHeaderSize + 8},
+		{storage.BooleanValue(true), pointHeaderSize + 1},
+		{storage.BooleanValue(false), pointHeaderSize + 1},
+		{storage.StringValue(""), pointHeaderSize + 4},
+		{storage.StringValue("hello world"), pointHeaderSize + 4 + 11},
+	}
+
+	var rawPoints []byte
+	var expected []decodedPoint
+	for i, test := range tests {
+		timestamp := int64(1500000000000000000 + i)
+		buf := encodePoint(timestamp, test.value)
+		if len(buf) != test.size {
+			t.Errorf("%v: expected a record of %d bytes, got %d", test.value, test.size, len(buf))
+		}
+
+		rawPoints = append(rawPoints, buf...)
+		expected = append(expected, decodedPoint{timestamp, test.value})
+	}
+
+	points, err := decodeAll(rawPoints)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("Expected %v, got %v", expected, points)
+	}
+}
+
+func TestDecodePointsRejects(t *testing.T) {
+	valid := string(encodePoint(1, storage.FloatValue(1)))
+	str := string(encodePoint(2, storage.StringValue("abc")))
+	unknown := make([]byte, pointHeaderSize+8)
+	unknown[8] = 0xff
+
+	tests := []struct {
+		name      string
+		rawPoints string
+		err       string
+	}{
+		{"truncated header", valid + valid[:5], "Found a truncated record of 5 bytes after 1 points"},
+		{"truncated float", valid[:pointHeaderSize+4], "Found a truncated record of 13 bytes after 0 points"},
+		{"truncated string", valid + str[:len(str)-1], "Found a truncated record of 15 bytes after 1 points"},
+		{"huge string length", str[:pointHeaderSize] + "\xff\xff\xff\xff", "Found a truncated record of 13 bytes after 0 points"},
+		{"unknown type", string(unknown), "Found a record of unknown type 255 after 0 points"},
+		{"legacy record", strings.Repeat("\x00", legacyPointSize), "Found a record of unknown type 0 after 0 points"},
+	}
+
+	for _, test := range tests {
+		err := validatePoints([]byte(test.rawPoints))
+		if err == nil {
+			t.Errorf("%s: expected error '%s', got none", test.name, test.err)
+		} else if err.Error() != test.err {
+			t.Errorf("%s: expected error '%s', got '%s'", test.name, test.err, err.Error())
+		}
+	}
+}
+
+func TestConvertLegacyPoints(t *testing.T) {
+	legacy := make([]byte, 2*legacyPointSize)
+	conversion.Int64ToBinary(legacy[0:8], 1500000000000000000)
+	conversion.Float64ToBinary(legacy[8:16], 1.5)
+	conversion.Int64ToBinary(legacy[16:24], 1500000001000000000)
+	conversion.Float64ToBinary(legacy[24:32], -3)
+
+	converted, err := convertLegacyPoints(legacy)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	points, err := decodeAll(converted)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []decodedPoint{
+		{1500000000000000000, storage.FloatValue(1.5)},
+		{1500000001000000000, storage.FloatValue(-3)},
+	}
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("Expected %v, got %v", expected, points)
+	}
+
+	if _, err := convertLegacyPoints(legacy[:20]); err == nil {
+		t.Errorf("Expected an error for a truncated record")
+	}
+}
+
+func TestParseKeyOfSchema(t *testing.T) {
+	tests := []struct {
+		key           string
+		schemaVersion int
+		expected      *parsedKey
+	}{
+		{dataKey("a.b", 14400, 42), SCHEMA_VERSION, &parsedKey{"a.b", 14400, 42, keyTypeData}},
+		{indexKey("a.b", -14400), SCHEMA_VERSION, &parsedKey{"a.b", -14400, 0, keyTypeIndex}},
+		{summaryKey("a.b", 0), SCHEMA_VERSION, &parsedKey{"a.b", 0, 0, keyTypeSummary}},
+		{"chronodium-1-{metric-a.b}-14400-28800-raw-7", LEGACY_SCHEMA_VERSION, &parsedKey{"a.b", 28800, 7, keyTypeData}},
+		{"chronodium-1-{metric-a.b}-14400-28800-raw-7", SCHEMA_VERSION, nil},
+		{dataKey("a.b", 14400, 42), LEGACY_SCHEMA_VERSION, nil},
+		{"chronodium-2-{metric-a.b}-3600-0-raw", SCHEMA_VERSION, nil},
+		{"something-else", SCHEMA_VERSION, nil},
+	}
+
+	for _, test := range tests {
+		parsed, ok := parseKeyOfSchema(test.key, test.schemaVersion)
+		if test.expected == nil && ok {
+			t.Errorf("%s (schema %d): expected no match, got %+v", test.key, test.schemaVersion, parsed)
+		} else if test.expected != nil && (!ok || *parsed != *test.expected) {
+			t.Errorf("%s (schema %d): expected %+v, got %+v", test.key, test.schemaVersion, test.expected, parsed)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"time"
+
+	"chronodium/server/tier"
+	"chronodium/storage"
+
+	"gopkg.in/redis.v5"
+)
+
+// How long a worker assumes the expiry it has set on a key is still in place
+const expiryRefreshInterval = 10 * time.Minute
+
+// Sets the expiry of a key, unless it already expires later. As the clock
+// cannot be relied upon in scripts, the remaining time is passed as well.
+//
+// KEYS: the key
+// ARGV: expiry (ms since the epoch), ms until the expiry
+const extendExpiryScript = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -1 or (ttl >= 0 and ttl < tonumber(ARGV[2])) then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[1])
+end
+return ttl
+`
+
+// getRetention returns how long the points of a metric are kept after the
+// end of their bucket, which depends on its tier set.
+func (r *Redis) getRetention(metric storage.Metric) time.Duration {
+	if metric.TierSet() != "" {
+		if tierSet := tier.GetTierSet(r.tierSets, metric.TierSet()); tierSet != nil {
+			return tierSet.Retention()
+		}
+	}
+
+	return dataTtl
+}
+
+// getExpiry returns the time at which the keys of a bucket expire, when
+// retained for the default period.
+func (r *Redis) getExpiry(shardKey string, bucket int) time.Time {
+	return r.getExpiryAfter(shardKey, bucket, dataTtl)
+}
+
+// getExpiryAfter returns the time at which the keys of a bucket expire, when
+// retained for the given period after the end of the bucket.
+func (r *Redis) getExpiryAfter(shardKey string, bucket int, retention time.Duration) time.Time {
+	_, end := r.getBucketBounds(shardKey, bucket)
+	return end.Add(retention)
+}
+
+// extendExpiry queues setting the expiry of a key shared by series that may
+// be retained for different periods, so that it is never shortened.
+func extendExpiry(client *redis.Pipeline, redisKey string, expiry time.Time) {
+	client.Eval(extendExpiryScript, []string{redisKey},
+		expiry.UnixNano()/int64(time.Millisecond), int64(expiry.Sub(time.Now())/time.Millisecond))
+}
+
+// expirySet keeps track of the keys a worker has set the expiry for. As the
+// expiry of a key only depends on its bucket and the retention of the series
+// stored in it, setting it once per key suffices and setting it again is
+// harmless. It is set again if a later expiry is requested.
+//
+// Keys can be deleted and recreated without an expiry in the meantime (e.g.
+// by the delete or restore commands), so keys are forgotten after a while
+// to have their expiry set again.
+type expirySet struct {
+	keys       map[string]expiryEntry // by redis key
+	lastPruned time.Time
+}
+
+type expiryEntry struct {
+	expiry time.Time
+	set    time.Time // When the expiry was set
+}
+
+func newExpirySet() *expirySet {
+	return &expirySet{
+		keys:       make(map[string]expiryEntry, 0),
+		lastPruned: time.Now(),
+	}
+}
+
+// needsExpiry reports whether the given expiry of a key still has to be set,
+// and assumes it will be if so.
+func (e *expirySet) needsExpiry(redisKey string, expiry time.Time) bool {
+	if entry, exists := e.keys[redisKey]; exists && !entry.expiry.Before(expiry) {
+		return false
+	}
+
+	e.keys[redisKey] = expiryEntry{expiry, time.Now()}
+	return true
+}
+
+func (e *expirySet) reset() {
+	e.keys = make(map[string]expiryEntry, 0)
+}
+
+func (e *expirySet) prune() {
+	now := time.Now()
+	if now.Sub(e.lastPruned) < expiryRefreshInterval/10 {
+		return
+	}
+	e.lastPruned = now
+
+	refresh := now.Add(-1 * expiryRefreshInterval)
+	for redisKey, entry := range e.keys {
+		if entry.set.Before(refresh) {
+			delete(e.keys, redisKey)
+		}
+	}
+}
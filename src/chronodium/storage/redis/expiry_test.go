@@ -0,0 +1,107 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"chronodium/server/tier"
+	"chronodium/storage"
+)
+
+func newTierSets(t *testing.T) []*tier.TierSet {
+	tiers := map[string]*tier.Tier{
+		"minutes": {RawGranularity: "PT1M", RawTtl: "P1D"},
+		"days":    {RawGranularity: "P1D", RawTtl: "P1Y"},
+	}
+	for name, v := range tiers {
+		if err := v.Validate(); err != nil {
+			t.Fatalf("Invalid tier %s: %s", name, err.Error())
+		}
+	}
+
+	tierSets := map[string]*tier.TierSet{
+		"short": {Match: ".*", RawTiers: []string{"minutes"}},
+		"long":  {Match: ".*", RawTiers: []string{"minutes", "days"}},
+	}
+	for name, v := range tierSets {
+		if err := v.Validate(tiers); err != nil {
+			t.Fatalf("Invalid tier set %s: %s", name, err.Error())
+		}
+	}
+
+	return tier.GetOrderedTierSets(tierSets)
+}
+
+func TestGetRetention(t *testing.T) {
+	r := &Redis{tierSets: newTierSets(t)}
+
+	tests := []struct {
+		tierSet   string
+		retention time.Duration
+	}{
+		{"", dataTtl},
+		{"unknown", dataTtl},
+		{"short", 24 * time.Hour},
+		{"long", 365 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		m := storage.NewMetric("cpu", storage.FloatValue(1), time.Now(), nil, test.tierSet)
+		if retention := r.getRetention(m); retention != test.retention {
+			t.Errorf("%q: expected a retention of %s, got %s", test.tierSet, test.retention, retention)
+		}
+	}
+}
+
+// Metrics written to databases with different tier sets expire at different
+// times, even within the same bucket. The index of the bucket lasts as long
+// as the longest retained series.
+func TestExpiryPerTierSet(t *testing.T) {
+	r := &Redis{tierSets: newTierSets(t)}
+
+	ts := time.Unix(1500000000, 0)
+	short := storage.NewMetric("cpu", storage.FloatValue(1), ts, map[string]string{"_db": "a"}, "short")
+	long := storage.NewMetric("cpu", storage.FloatValue(1), ts, map[string]string{"_db": "b"}, "long")
+
+	bucket := r.getBucket("cpu", &ts)
+	shortExpiry := r.getExpiryAfter("cpu", bucket, r.getRetention(short))
+	longExpiry := r.getExpiryAfter("cpu", bucket, r.getRetention(long))
+	if !shortExpiry.Before(longExpiry) {
+		t.Fatalf("Expected %s to expire before %s", shortExpiry, longExpiry)
+	}
+
+	_, end := r.getBucketBounds("cpu", bucket)
+	if d := longExpiry.Sub(shortExpiry); d != 364*24*time.Hour {
+		t.Errorf("Expected the expiries to differ by 364 days, got %s", d)
+	}
+	if d := shortExpiry.Sub(end); d != 24*time.Hour {
+		t.Errorf("Expected the short series to expire a day after its bucket, got %s", d)
+	}
+
+	expiries := newExpirySet()
+	redisKey := indexKey("cpu", bucket)
+	if !expiries.needsExpiry(redisKey, shortExpiry) {
+		t.Errorf("Expected the expiry of a new key to be set")
+	}
+	if !expiries.needsExpiry(redisKey, longExpiry) {
+		t.Errorf("Expected a later expiry to be set")
+	}
+	if expiries.needsExpiry(redisKey, shortExpiry) {
+		t.Errorf("Expected an earlier expiry not to be set")
+	}
+}
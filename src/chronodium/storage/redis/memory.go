@@ -0,0 +1,189 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"chronodium/server/tier"
+	"chronodium/storage"
+
+	"gopkg.in/redis.v5"
+)
+
+// Called as a script so that the command is routed to the right node in
+// cluster mode. Nested values are sampled as per the default of 5 samples.
+const memoryUsageScript = "return redis.call('MEMORY', 'USAGE', KEYS[1])"
+
+// The number of keys per metric key and key type whose memory usage is
+// determined, the usage of other keys is extrapolated from these.
+const memorySamplesPerMetric = 8
+
+// How long keys are scanned for, the report only covers the keys that were
+// found before then.
+const memoryScanTimeout = 1 * time.Minute
+
+var errMemoryScanTimeout = errors.New("memory scan timed out")
+
+// Reported for metric keys that do not match any tier set
+const noTierSet = "-"
+
+// memorySamples holds the number of keys of a metric key, and the memory
+// used by a sample of them, by key type.
+type memorySamples struct {
+	keys    [3]int64
+	sampled [3]int64
+	bytes   [3]int64
+}
+
+// estimate extrapolates the memory used by all keys from the samples
+func (m *memorySamples) estimate() int64 {
+	total := int64(0)
+	for keyType := range m.keys {
+		if m.sampled[keyType] > 0 {
+			total += m.bytes[keyType] * m.keys[keyType] / m.sampled[keyType]
+		}
+	}
+
+	return total
+}
+
+// GetMemoryUsage reports the memory used, the number of keys and the number
+// of distinct series (metadata sets) per metric key and per tier set. The
+// memory used is estimated from a sample of the keys of every metric key.
+func (r *Redis) GetMemoryUsage(pattern string) (*storage.MemoryReport, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	report := &storage.MemoryReport{
+		Total:    &storage.MemoryUsage{},
+		Metrics:  make(map[string]*storage.MemoryUsage, 0),
+		TierSets: make(map[string]*storage.MemoryUsage, 0),
+	}
+	samples := make(map[string]*memorySamples, 0)     // by metric key
+	series := make(map[string]map[uint32]struct{}, 0) // by metric key
+
+	var lock sync.Mutex
+	deadline := time.Now().Add(memoryScanTimeout)
+	err := r.scanKeys(fmt.Sprintf("chronodium-%d-{metric-%s}-%d-*", SCHEMA_VERSION, pattern, bucketWindow), func(keys []string) error {
+		if time.Now().After(deadline) {
+			return errMemoryScanTimeout
+		}
+
+		lock.Lock()
+		sampleKeys := make([]string, 0)
+		sampleParsed := make([]*parsedKey, 0)
+		for _, key := range keys {
+			parsed, ok := parseKey(key)
+			if !ok {
+				continue
+			}
+
+			sample, exists := samples[parsed.shardKey]
+			if !exists {
+				sample = &memorySamples{}
+				samples[parsed.shardKey] = sample
+				series[parsed.shardKey] = make(map[uint32]struct{}, 0)
+			}
+			if parsed.keyType == keyTypeData {
+				series[parsed.shardKey][parsed.metadataHash] = struct{}{}
+			}
+
+			sample.keys[parsed.keyType]++
+			if sample.sampled[parsed.keyType] < memorySamplesPerMetric {
+				sample.sampled[parsed.keyType]++
+				sampleKeys = append(sampleKeys, key)
+				sampleParsed = append(sampleParsed, parsed)
+			}
+		}
+		lock.Unlock()
+
+		if len(sampleKeys) == 0 {
+			return nil
+		}
+
+		cmds := make([]*redis.Cmd, len(sampleKeys))
+		_, err := r.client.Pipelined(func(pipeline *redis.Pipeline) error {
+			for i, key := range sampleKeys {
+				cmds[i] = pipeline.Eval(memoryUsageScript, []string{key})
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		for i, key := range sampleKeys {
+			parsed := sampleParsed[i]
+			sample := samples[parsed.shardKey]
+
+			used, err := cmds[i].Result()
+			if err == redis.Nil {
+				// Expired in the meantime
+				sample.keys[parsed.keyType]--
+				sample.sampled[parsed.keyType]--
+				continue
+			} else if err != nil {
+				return fmt.Errorf("Could not determine memory usage of %s: %s", key, err.Error())
+			}
+
+			bytes, _ := used.(int64)
+			sample.bytes[parsed.keyType] += bytes
+		}
+
+		return nil
+	})
+	if err == errMemoryScanTimeout {
+		report.Partial = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	for shardKey, sample := range samples {
+		usage := &storage.MemoryUsage{
+			Bytes:  sample.estimate(),
+			Series: int64(len(series[shardKey])),
+		}
+		for _, keys := range sample.keys {
+			usage.Keys += keys
+		}
+		report.Metrics[shardKey] = usage
+
+		tierSetId := noTierSet
+		if tierSet := tier.GetTierSetForKey(r.tierSets, shardKey); tierSet != nil {
+			tierSetId = tierSet.Id
+		}
+
+		if _, exists := report.TierSets[tierSetId]; !exists {
+			report.TierSets[tierSetId] = &storage.MemoryUsage{}
+		}
+
+		for _, total := range []*storage.MemoryUsage{report.TierSets[tierSetId], report.Total} {
+			total.Bytes += usage.Bytes
+			total.Keys += usage.Keys
+			total.Series += usage.Series
+		}
+	}
+
+	return report, nil
+}
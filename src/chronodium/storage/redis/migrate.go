@@ -0,0 +1,128 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// Prepends the converted points of a series of an older schema version to
+// the series of the current version, which may have been written to since
+// upgrading, and removes the old series. A later expiry of the new series,
+// due to the retention of its tier set, is kept.
+//
+// KEYS: old data key, new data key, new summary key
+// ARGV: converted points, expiry in milliseconds since the epoch, metadata
+// hash, milliseconds until the expiry
+const migrateSeriesScript = `
+local current = redis.call('GET', KEYS[2]) or ''
+local ttl = redis.call('PTTL', KEYS[2])
+redis.call('SET', KEYS[2], ARGV[1] .. current)
+if ttl > tonumber(ARGV[4]) then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+else
+	redis.call('PEXPIREAT', KEYS[2], ARGV[2])
+end
+redis.call('DEL', KEYS[1])
+
+-- The summary is recreated at query time
+redis.call('HDEL', KEYS[3], ARGV[3])
+return 1
+`
+
+// Merges an index of an older schema version into the index of the current
+// version, and removes the old index. A later expiry of the new index is kept.
+//
+// KEYS: old index key, new index key
+// ARGV: expiry in milliseconds since the epoch, milliseconds until the expiry
+const migrateIndexScript = `
+local ttl = redis.call('PTTL', KEYS[2])
+redis.call('ZUNIONSTORE', KEYS[2], 2, KEYS[2], KEYS[1])
+if ttl > tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+else
+	redis.call('PEXPIREAT', KEYS[2], ARGV[1])
+end
+redis.call('DEL', KEYS[1])
+return 1
+`
+
+// Migrate converts all keys of the previous schema version to the current
+// one. Keys of buckets that have expired already, and summaries, are removed
+// instead. Keys that cannot be converted are logged and skipped, so that
+// they do not hold back the others. Returns the number of keys converted
+// and skipped.
+func (r *Redis) Migrate() (migrated, skipped int, err error) {
+	var lock sync.Mutex
+	err = r.scanKeys(fmt.Sprintf("chronodium-%d-{metric-*", LEGACY_SCHEMA_VERSION), func(keys []string) error {
+		for _, key := range keys {
+			parsed, ok := parseKeyOfSchema(key, LEGACY_SCHEMA_VERSION)
+			if !ok {
+				continue
+			}
+
+			err := r.migrateKey(key, parsed)
+			if err == redis.Nil {
+				continue // Expired in the meantime
+			}
+
+			lock.Lock()
+			if err != nil {
+				log.Printf("Could not migrate %s: %s", key, err.Error())
+				skipped++
+			} else {
+				migrated++
+			}
+			lock.Unlock()
+		}
+		return nil
+	})
+
+	return migrated, skipped, err
+}
+
+func (r *Redis) migrateKey(key string, parsed *parsedKey) error {
+	// Keys of the previous schema were retained for the default period
+	expiry := r.getExpiry(parsed.shardKey, parsed.bucket)
+	if parsed.keyType == keyTypeSummary || !expiry.After(time.Now()) {
+		return r.client.Del(key).Err()
+	}
+	expireAt := strconv.FormatInt(expiry.UnixNano()/int64(time.Millisecond), 10)
+	remaining := strconv.FormatInt(int64(expiry.Sub(time.Now())/time.Millisecond), 10)
+
+	if parsed.keyType == keyTypeIndex {
+		keys := []string{key, indexKey(parsed.shardKey, parsed.bucket)}
+		return r.client.Eval(migrateIndexScript, keys, expireAt, remaining).Err()
+	}
+
+	rawPoints, err := r.client.Get(key).Bytes()
+	if err != nil {
+		return err
+	}
+	points, err := convertLegacyPoints(rawPoints)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{key, dataKey(parsed.shardKey, parsed.bucket, parsed.metadataHash), summaryKey(parsed.shardKey, parsed.bucket)}
+	return r.client.Eval(migrateSeriesScript, keys, string(points), expireAt, strconv.FormatUint(uint64(parsed.metadataHash), 10), remaining).Err()
+}
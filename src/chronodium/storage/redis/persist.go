@@ -18,31 +18,52 @@ package redis
 import (
 	"bytes"
 	"fmt"
+	"regexp"
 	"sort"
+	"strconv"
 	"time"
 
 	"chronodium/storage"
-	"chronodium/util/conversion"
 
 	"github.com/twmb/murmur3"
 	"gopkg.in/redis.v5"
 )
 
-const SCHEMA_VERSION = 1
+const SCHEMA_VERSION = 2
+
+// Keys of schema version 1 hold floats only, see convertLegacyPoints. They
+// are converted by Migrate.
+const LEGACY_SCHEMA_VERSION = 1
 
 const bucketWindow = 14400
 
+// How long keys are retained after the end of their bucket, unless the
+// metric has a tier set
+const dataTtl = 25 * time.Hour
+
 func (r *Redis) persistMetrics(metrics <-chan storage.Metric) {
 	ticker := time.NewTicker(1 * time.Second)
+	expiries := newExpirySet()
 
 	client := r.getNewClient()
 	pipeline := client.Pipeline()
+	var stale []string
 	for metric := range metrics {
-		r.persistMetric(pipeline, metric)
+		stale = append(stale, r.persistMetric(pipeline, metric, expiries)...)
 
 		select {
 		case <-ticker.C:
-			pipeline.Exec()
+			if _, err := pipeline.Exec(); err != nil {
+				// Not all expiries may have been set
+				expiries.reset()
+			}
+			expiries.prune()
+
+			// Only once the points have been written, as a query could
+			// otherwise cache the old contents again. Even a failed pipeline
+			// may have been executed partially.
+			r.cache.remove(stale...)
+			stale = stale[:0]
 		default:
 		}
 	}
@@ -53,24 +74,123 @@ func (r *Redis) getBucket(shardKey string, timestamp *time.Time) int {
 	return int((timestamp.Unix()-int64(keyHash>>16))/bucketWindow) * bucketWindow
 }
 
-func (r *Redis) persistMetric(client *redis.Pipeline, metric storage.Metric) {
+// getBucketBounds returns the time range covered by a bucket, the end
+// being exclusive.
+func (r *Redis) getBucketBounds(shardKey string, bucket int) (start, end time.Time) {
+	keyHash := int(murmur3.Sum32([]byte(shardKey)))
+	start = time.Unix(int64(bucket)+int64(keyHash>>16), 0)
+	return start, start.Add(bucketWindow * time.Second)
+}
+
+// persistMetric queues the commands to store a metric, and returns the keys
+// that are to be removed from the cache once they have been executed.
+func (r *Redis) persistMetric(client *redis.Pipeline, metric storage.Metric, expiries *expirySet) []string {
 	metricTime := metric.Time()
 	bucket := r.getBucket(metric.Key(), &metricTime)
 
 	metadata := orderableMap(metric.Metadata()).ToJson()
 	metadataHash := murmur3.Sum32(metadata)
+	if !r.limiter.allow(metric.Key(), bucket, metadataHash) {
+		return nil
+	}
 
-	redisKey := fmt.Sprintf("chronodium-%d-{metric-%s}-%d-%d-raw-%d", SCHEMA_VERSION, metric.Key(), bucketWindow, bucket, metadataHash)
+	redisKey := dataKey(metric.Key(), bucket, metadataHash)
+	expiry := r.getExpiryAfter(metric.Key(), bucket, r.getRetention(metric))
 
-	buf := make([]byte, 16)
-	conversion.Int64ToBinary(buf[0:8], metric.Time().UnixNano())
-	conversion.Float64ToBinary(buf[8:16], metric.Value())
-	client.Append(redisKey, string(buf))
-	client.Expire(redisKey, 25*time.Hour)
+	client.Append(redisKey, string(encodePoint(metric.Time().UnixNano(), metric.Value())))
+	if expiries.needsExpiry(redisKey, expiry) {
+		client.ExpireAt(redisKey, expiry)
+	}
 
-	redisKey = fmt.Sprintf("chronodium-%d-{metric-%s}-%d-%d-raw", SCHEMA_VERSION, metric.Key(), bucketWindow, bucket)
+	// The index must not expire before any of the series it lists
+	redisKey = indexKey(metric.Key(), bucket)
 	client.ZAdd(redisKey, redis.Z{float64(metadataHash), fmt.Sprintf("%d-%s", bucket, metadata)})
-	client.Expire(redisKey, 25*time.Hour)
+	if expiries.needsExpiry(redisKey, expiry) {
+		extendExpiry(client, redisKey, expiry)
+	}
+
+	r.summarizer.track(metric.Key(), bucket, metadataHash, expiry)
+	if !r.isSealed(metric.Key(), bucket) {
+		return nil
+	}
+
+	// Points that arrive really late must not be hidden by the cache,
+	// and render the summary outdated.
+	client.HDel(summaryKey(metric.Key(), bucket), strconv.FormatUint(uint64(metadataHash), 10))
+	return []string{redisKey, dataKey(metric.Key(), bucket, metadataHash)}
+}
+
+// dataKey returns the key holding the packed points of a single series
+// (metric key plus metadata set) within a bucket.
+func dataKey(shardKey string, bucket int, metadataHash uint32) string {
+	return fmt.Sprintf("%s-%d", indexKey(shardKey, bucket), metadataHash)
+}
+
+// indexKey returns the key of the sorted set that lists the metadata sets
+// stored for a metric key within a bucket.
+func indexKey(shardKey string, bucket int) string {
+	return fmt.Sprintf("%s-%d-%d-raw", metricKeyPrefix(shardKey), bucketWindow, bucket)
+}
+
+// summaryKey returns the key of the hash that holds the summaries of all
+// series within a bucket, by metadata hash.
+func summaryKey(shardKey string, bucket int) string {
+	return fmt.Sprintf("%s-%d-%d-summary", metricKeyPrefix(shardKey), bucketWindow, bucket)
+}
+
+func metricKeyPrefix(shardKey string) string {
+	return fmt.Sprintf("chronodium-%d-{metric-%s}", SCHEMA_VERSION, shardKey)
+}
+
+const (
+	keyTypeData = iota
+	keyTypeIndex
+	keyTypeSummary
+)
+
+type parsedKey struct {
+	shardKey     string
+	bucket       int
+	metadataHash uint32 // Only set for data keys
+	keyType      int
+}
+
+var keyRegex = regexp.MustCompile(fmt.Sprintf(`^chronodium-(\d+)-\{metric-(.*)\}-%d-(-?\d+)-(raw(?:-(\d+))?|summary)$`, bucketWindow))
+
+// parseKey is the inverse of dataKey, indexKey and summaryKey. It returns
+// false if the given key is not one of ours.
+func parseKey(redisKey string) (*parsedKey, bool) {
+	return parseKeyOfSchema(redisKey, SCHEMA_VERSION)
+}
+
+// parseKeyOfSchema is like parseKey, for keys of the given schema version
+func parseKeyOfSchema(redisKey string, schemaVersion int) (*parsedKey, bool) {
+	matches := keyRegex.FindStringSubmatch(redisKey)
+	if matches == nil || matches[1] != strconv.Itoa(schemaVersion) {
+		return nil, false
+	}
+
+	bucket, err := strconv.Atoi(matches[3])
+	if err != nil {
+		return nil, false
+	}
+
+	out := &parsedKey{shardKey: matches[2], bucket: bucket}
+	switch {
+	case matches[4] == "summary":
+		out.keyType = keyTypeSummary
+	case matches[5] == "":
+		out.keyType = keyTypeIndex
+	default:
+		hash, err := strconv.ParseUint(matches[5], 10, 32)
+		if err != nil {
+			return nil, false
+		}
+		out.keyType = keyTypeData
+		out.metadataHash = uint32(hash)
+	}
+
+	return out, true
 }
 
 type orderableMap map[string]string
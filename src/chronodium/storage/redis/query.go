@@ -16,8 +16,6 @@
 package redis
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -31,6 +29,10 @@ import (
 
 func (r *Redis) Query(query *storage.Query) storage.ResultSet {
 	buckets, _ := r.getBucketsInWindow(query.GetStartDate(), query.GetEndDate(), query.ShardKey)
+	if query.Step >= bucketWindow*time.Second {
+		return r.querySummaries(query, buckets)
+	}
+
 	entries := make(ResultSet, 0)
 	for _, bucket := range buckets {
 		entries = append(entries, r.queryBucket(query.ShardKey, bucket, query.Filter)...)
@@ -53,47 +55,48 @@ func (r *Redis) Query(query *storage.Query) storage.ResultSet {
 func (r *Redis) queryBucket(shardKey string, bucket int, filter map[string]string) []*datapoint {
 	out := make([]*datapoint, 0)
 
-	metadataHashes := r.getFilteredMetadataHashes(shardKey, bucket, filter)
+	metadataHashes, err := r.getFilteredMetadataHashes(shardKey, bucket, filter)
+	if err != nil {
+		log.Println("Error from Redis: ", err.Error())
+		return out
+	}
 	for hash, metadata := range metadataHashes {
-		redisKey := fmt.Sprintf("chronodium-%d-{metric-%s}-%d-%d-raw-%d", SCHEMA_VERSION, shardKey, bucketWindow, bucket, hash)
-		rawPoints, err := r.client.Get(redisKey).Bytes()
+		rawPoints, err := r.getRawPoints(shardKey, bucket, hash)
 		if err != nil {
 			log.Println("Error from Redis: ", err.Error())
 			return out
 		}
 
-		out = append(out, r.unpackPoints(rawPoints, metadata)...)
+		points, err := r.unpackPoints(rawPoints, metadata)
+		if err != nil {
+			log.Printf("Error unpacking %s: %s", dataKey(shardKey, bucket, hash), err.Error())
+		}
+		out = append(out, points...)
 	}
 
 	return out
 }
 
-func (r *Redis) unpackPoints(rawPoints []byte, metadata map[string]string) []*datapoint {
-	out := make([]*datapoint, 0, len(rawPoints)/16)
-	buf := bytes.NewBuffer(rawPoints)
-
-	var timestamp int64
-	var value float64
-
-	length := len(rawPoints)
-	for i := 0; i < length; i = i + 16 {
-		binary.Read(buf, binary.LittleEndian, &timestamp)
-		binary.Read(buf, binary.LittleEndian, &value)
+func (r *Redis) unpackPoints(rawPoints []byte, metadata map[string]string) ([]*datapoint, error) {
+	out := make([]*datapoint, 0, len(rawPoints)/(pointHeaderSize+8))
 
-		out = append(out, &datapoint{timestamp, value, metadata})
-	}
+	err := decodePoints(rawPoints, func(timestamp int64, value storage.Value) {
+		out = append(out, &datapoint{timestamp: timestamp, value: value, metadata: metadata})
+	})
 
-	return out
+	return out, err
 }
 
-func (r *Redis) getFilteredMetadataHashes(shardKey string, bucket int, filter map[string]string) map[int]map[string]string {
-	redisKey := fmt.Sprintf("chronodium-%d-{metric-%s}-%d-%d-raw", SCHEMA_VERSION, shardKey, bucketWindow, bucket)
-	res, _ := r.client.ZRangeWithScores(redisKey, 0, -1).Result()
+func (r *Redis) getFilteredMetadataHashes(shardKey string, bucket int, filter map[string]string) (map[uint32]map[string]string, error) {
+	res, err := r.getIndex(shardKey, bucket)
+	if err != nil {
+		return nil, err
+	}
 
-	metadataHashes := make(map[int]map[string]string, 0)
+	metadataHashes := make(map[uint32]map[string]string, 0)
 RowLoop:
 	for _, z := range res {
-		hash := int(z.Score)
+		hash := uint32(z.Score)
 
 		metadata := make(map[string]string, 0)
 		jsonString := z.Member.(string)
@@ -117,7 +120,7 @@ RowLoop:
 		metadataHashes[hash] = metadata
 	}
 
-	return metadataHashes
+	return metadataHashes, nil
 }
 
 func (r *Redis) getBucketsInWindow(startTime, endTime time.Time, shardKey string) ([]int, error) {
@@ -141,10 +144,18 @@ func (r *Redis) GetMetricNames() (metricNames []string, err error) {
 	return []string{}, nil
 }
 
+func (r *Redis) Stats() map[string]int64 {
+	stats := r.cache.stats()
+	stats["series_rejected"] = int64(r.limiter.RejectedTotal())
+
+	return stats
+}
+
 type datapoint struct {
 	timestamp int64
-	value     float64
+	value     storage.Value
 	metadata  map[string]string
+	summary   *summary // Only set when the value is the average of a bucket
 }
 
 type datapointGroup struct {
@@ -168,13 +179,21 @@ func (p ResultSet) Swap(i, j int) {
 }
 
 func (p *datapoint) MarshalJSON() ([]byte, error) {
-	out := make(map[string]string, len(p.metadata)+2)
+	out := make(map[string]string, len(p.metadata)+3)
 	for k, v := range p.metadata {
 		out[k] = v
 	}
 
 	out["_date"] = time.Unix(0, p.timestamp).UTC().Format(time.RFC3339Nano)
-	out["_value"] = strconv.FormatFloat(p.value, 'f', -1, 64)
+	out["_value"] = p.value.String()
+	out["_type"] = p.value.Type().String()
+	if p.summary != nil {
+		out["_count"] = strconv.FormatInt(p.summary.count, 10)
+		out["_min"] = strconv.FormatFloat(p.summary.min, 'f', -1, 64)
+		out["_max"] = strconv.FormatFloat(p.summary.max, 'f', -1, 64)
+		out["_sum"] = strconv.FormatFloat(p.summary.sum, 'f', -1, 64)
+		out["_last_date"] = time.Unix(0, p.summary.last).UTC().Format(time.RFC3339Nano)
+	}
 	return json.Marshal(out)
 
 }
@@ -16,6 +16,7 @@
 package redis
 
 import (
+	"bytes"
 	"log"
 	"runtime"
 	"sync"
@@ -32,7 +33,7 @@ const WORKERS = 48 // TODO: Make configurable
 
 type Metric interface {
 	Key() string
-	Value() float64
+	Value() storage.Value
 	Time() time.Time
 }
 
@@ -40,6 +41,15 @@ type Config struct {
 	ClientType string `gcfg:"client-type"` // must be one of 'standalone' or 'cluster'
 	Address    []string
 	Password   string
+
+	// The maximum number of distinct metadata sets per metric key per bucket,
+	// and across all metric keys. Zero means unlimited.
+	MaxSeriesPerMetric int `gcfg:"max-series-per-metric"`
+	MaxSeries          int `gcfg:"max-series"`
+
+	// The memory budget in bytes for caching sealed buckets on the query path.
+	// Zero disables the cache.
+	QueryCacheSize int64 `gcfg:"query-cache-size"`
 }
 
 type Redis struct {
@@ -49,6 +59,10 @@ type Redis struct {
 
 	sources map[string]<-chan storage.Metric
 	client  redis.Cmdable
+	limiter *cardinalityLimiter
+	cache   *bucketCache
+
+	summarizer *summarizer
 }
 
 func NewRedis(config *Config, stopper *stop.Stopper, tierSets []*tier.TierSet) *Redis {
@@ -71,6 +85,10 @@ func NewRedis(config *Config, stopper *stop.Stopper, tierSets []*tier.TierSet) *
 		stopper:  stopper,
 		tierSets: tierSets,
 		sources:  make(map[string]<-chan storage.Metric, 0),
+		limiter:  newCardinalityLimiter(config),
+		cache:    newBucketCache(config),
+
+		summarizer: newSummarizer(),
 	}
 
 	out.client = out.getNewClient()
@@ -92,6 +110,10 @@ func (r *Redis) Start() {
 	}
 
 	go r.monitorSourceSizes(metrics)
+	if r.limiter != nil {
+		go r.limiter.monitor()
+	}
+	go r.summarizeSealedBuckets()
 }
 
 func (r *Redis) getNewClient() redis.Cmdable {
@@ -110,6 +132,54 @@ func (r *Redis) getNewClient() redis.Cmdable {
 	})
 }
 
+// scanKeys invokes fn for every batch of keys matching the given pattern.
+// In cluster mode all masters are scanned, fn may then be called concurrently.
+func (r *Redis) scanKeys(pattern string, fn func(keys []string) error) error {
+	scan := func(client redis.Cmdable) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, pattern, 1000).Result()
+			if err != nil {
+				return err
+			}
+
+			if len(keys) > 0 {
+				if err := fn(keys); err != nil {
+					return err
+				}
+			}
+
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	}
+
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return scan(client)
+		})
+	}
+
+	return scan(r.client)
+}
+
+// escapeGlob escapes the characters that have a special meaning in
+// the patterns used by SCAN and KEYS.
+func escapeGlob(str string) string {
+	buf := &bytes.Buffer{}
+	for _, c := range str {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+
+	return buf.String()
+}
+
 func (r *Redis) monitorSourceSizes(metrics <-chan storage.Metric) {
 	displaySize := func(name string, metric <-chan storage.Metric) {
 		log.Printf("Queue %s has %d items", name, len(metric))
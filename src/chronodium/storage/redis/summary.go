@@ -0,0 +1,224 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package redis
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"chronodium/storage"
+
+	"gopkg.in/redis.v5"
+)
+
+const summarizeInterval = 1 * time.Minute
+
+// summary describes all points of a series within a bucket
+type summary struct {
+	count int64
+	min   float64
+	max   float64
+	sum   float64
+	first int64 // Timestamp of the first point
+	last  int64 // Timestamp of the last point
+}
+
+// add adds a point to the summary, non-numeric values are ignored
+func (s *summary) add(timestamp int64, v storage.Value) {
+	if !v.IsNumeric() {
+		return
+	}
+
+	value := v.Float()
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	if s.count == 0 || timestamp < s.first {
+		s.first = timestamp
+	}
+	if s.count == 0 || timestamp > s.last {
+		s.last = timestamp
+	}
+
+	s.count++
+	s.sum += value
+}
+
+// summarizer keeps track of the series that were written to, so that a
+// summary can be stored once their bucket has been sealed.
+//
+// Series are tracked in memory only. Series of which the summary is missing
+// (e.g. because of a restart) are summarized on the fly at query time.
+type summarizer struct {
+	lock    sync.Mutex
+	pending map[string]pendingSeries // by data key
+}
+
+type pendingSeries struct {
+	shardKey     string
+	bucket       int
+	metadataHash uint32
+	expiry       time.Time // Of the series
+}
+
+func newSummarizer() *summarizer {
+	return &summarizer{
+		pending: make(map[string]pendingSeries, 0),
+	}
+}
+
+func (s *summarizer) track(shardKey string, bucket int, metadataHash uint32, expiry time.Time) {
+	redisKey := dataKey(shardKey, bucket, metadataHash)
+
+	s.lock.Lock()
+	if pending, exists := s.pending[redisKey]; !exists || pending.expiry.Before(expiry) {
+		s.pending[redisKey] = pendingSeries{shardKey, bucket, metadataHash, expiry}
+	}
+	s.lock.Unlock()
+}
+
+// summarizeSealedBuckets periodically stores the summaries of all
+// tracked series of which the bucket has been sealed.
+func (r *Redis) summarizeSealedBuckets() {
+	ticker := time.NewTicker(summarizeInterval)
+	for range ticker.C {
+		sealed := make([]pendingSeries, 0)
+
+		r.summarizer.lock.Lock()
+		for redisKey, series := range r.summarizer.pending {
+			if r.isSealed(series.shardKey, series.bucket) {
+				sealed = append(sealed, series)
+				delete(r.summarizer.pending, redisKey)
+			}
+		}
+		r.summarizer.lock.Unlock()
+
+		for _, series := range sealed {
+			if err := r.storeSummary(series); err != nil {
+				log.Printf("Could not summarize %s: %s",
+					dataKey(series.shardKey, series.bucket, series.metadataHash), err.Error())
+			}
+		}
+	}
+}
+
+func (r *Redis) storeSummary(series pendingSeries) error {
+	rawPoints, err := r.getRawPoints(series.shardKey, series.bucket, series.metadataHash)
+	if err != nil {
+		return err
+	}
+
+	s := &summary{}
+	if err := decodePoints(rawPoints, s.add); err != nil {
+		return err
+	}
+	if s.count == 0 {
+		return nil
+	}
+
+	buf := make([]byte, summarySize)
+	encodeSummary(buf, s)
+
+	redisKey := summaryKey(series.shardKey, series.bucket)
+	_, err = r.client.Pipelined(func(pipeline *redis.Pipeline) error {
+		pipeline.HSet(redisKey, strconv.FormatUint(uint64(series.metadataHash), 10), string(buf))
+		extendExpiry(pipeline, redisKey, series.expiry)
+		return nil
+	})
+	return err
+}
+
+// getSummaries returns the stored summaries of a bucket by metadata hash
+func (r *Redis) getSummaries(shardKey string, bucket int) map[uint32]*summary {
+	out := make(map[uint32]*summary, 0)
+
+	res, err := r.client.HGetAll(summaryKey(shardKey, bucket)).Result()
+	if err != nil {
+		log.Println("Error from Redis: ", err.Error())
+		return out
+	}
+
+	for field, value := range res {
+		hash, err := strconv.ParseUint(field, 10, 32)
+		if err != nil || len(value) != summarySize {
+			continue
+		}
+		out[uint32(hash)] = decodeSummary([]byte(value))
+	}
+
+	return out
+}
+
+// querySummaries returns a single point per series per bucket, describing
+// all points of that series in the bucket. Stored summaries are used for
+// sealed buckets that lie completely within the queried range.
+func (r *Redis) querySummaries(query *storage.Query, buckets []int) ResultSet {
+	startTime := query.StartDate.UnixNano()
+	endTime := query.EndDate.UnixNano()
+
+	out := make(ResultSet, 0)
+	for _, bucket := range buckets {
+		start, end := r.getBucketBounds(query.ShardKey, bucket)
+		stored := map[uint32]*summary{}
+		if start.After(query.StartDate) && !end.After(query.EndDate) && r.isSealed(query.ShardKey, bucket) {
+			stored = r.getSummaries(query.ShardKey, bucket)
+		}
+
+		metadataHashes, err := r.getFilteredMetadataHashes(query.ShardKey, bucket, query.Filter)
+		if err != nil {
+			log.Println("Error from Redis: ", err.Error())
+			continue
+		}
+
+		for hash, metadata := range metadataHashes {
+			s, ok := stored[hash]
+			if !ok {
+				rawPoints, err := r.getRawPoints(query.ShardKey, bucket, hash)
+				if err != nil {
+					log.Println("Error from Redis: ", err.Error())
+					continue
+				}
+
+				s = &summary{}
+				decodePoints(rawPoints, func(timestamp int64, value storage.Value) {
+					if timestamp > startTime && timestamp < endTime {
+						s.add(timestamp, value)
+					}
+				})
+			}
+
+			if s.count == 0 {
+				continue
+			}
+
+			out = append(out, &datapoint{
+				timestamp: s.first,
+				value:     storage.FloatValue(s.sum / float64(s.count)),
+				metadata:  metadata,
+				summary:   s,
+			})
+		}
+	}
+
+	sort.Sort(out)
+	return out
+}
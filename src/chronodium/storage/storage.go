@@ -15,18 +15,87 @@
 // limitations under the License.
 package storage
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 type Metric interface {
 	Key() string
-	Value() float64
+	Value() Value
 	Time() time.Time
 	Metadata() map[string]string
+
+	// TierSet returns the id of the tier set of which the retention applies
+	// to the metric, or an empty string for the default retention.
+	TierSet() string
+}
+
+// NewMetric returns a Metric holding the given fields, for use by stages
+// that rewrite metrics before they are stored.
+func NewMetric(key string, value Value, ts time.Time, metadata map[string]string, tierSet string) Metric {
+	return &metric{key, value, ts, metadata, tierSet}
+}
+
+type metric struct {
+	key      string
+	value    Value
+	ts       time.Time
+	metadata map[string]string
+	tierSet  string
+}
+
+func (m *metric) Key() string {
+	return m.key
+}
+
+func (m *metric) Value() Value {
+	return m.value
+}
+
+func (m *metric) Time() time.Time {
+	return m.ts
+}
+
+func (m *metric) Metadata() map[string]string {
+	return m.metadata
+}
+
+func (m *metric) TierSet() string {
+	return m.tierSet
 }
 
 type Repo interface {
 	GetMetricNames() (metricNames []string, err error)
 	Query(*Query) ResultSet
+
+	// Delete removes the points matching the query and returns the number
+	// of points that were removed. A zero start or end date leaves that
+	// side of the time range unbounded.
+	Delete(*Query) (deleted int, err error)
+
+	// Stats returns internal counters, such as those of caches
+	Stats() map[string]int64
+
+	// GetMemoryUsage reports the (estimated) memory used by the metric
+	// keys that match the given glob pattern.
+	GetMemoryUsage(pattern string) (*MemoryReport, error)
+}
+
+type MemoryUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Keys   int64 `json:"keys"`
+	Series int64 `json:"series"`
+}
+
+type MemoryReport struct {
+	Total    *MemoryUsage            `json:"total"`
+	Metrics  map[string]*MemoryUsage `json:"metrics"`
+	TierSets map[string]*MemoryUsage `json:"tier_sets"`
+
+	// Set if scanning took too long, and not all keys were reported
+	Partial bool `json:"partial"`
 }
 
 type ResultSet interface {
@@ -37,6 +106,10 @@ type Query struct {
 	StartDate time.Time
 	EndDate   time.Time
 	Filter    map[string]string
+
+	// When at least as wide as a bucket, a single point per series per
+	// bucket is returned that summarizes all points within that bucket.
+	Step time.Duration
 }
 
 func (q *Query) GetStartDate() time.Time {
@@ -46,3 +119,32 @@ func (q *Query) GetStartDate() time.Time {
 func (q *Query) GetEndDate() time.Time {
 	return q.EndDate
 }
+
+// AddFilter parses a filter in the form of 'key:value' and adds it to the query.
+func (q *Query) AddFilter(filterString string) error {
+	parts := strings.Split(filterString, ":")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("Invalid filter specified: %s", filterString)
+	}
+
+	if _, exists := q.Filter[parts[0]]; exists {
+		return fmt.Errorf("Cannot use same filter key more than once: %s", parts[0])
+	}
+
+	q.Filter[parts[0]] = parts[1]
+	return nil
+}
+
+// Contains reports whether the given timestamp (in nanoseconds) lies within
+// the (inclusive) time range of the query. Zero dates are unbounded.
+func (q *Query) Contains(timestamp int64) bool {
+	if !q.StartDate.IsZero() && timestamp < q.StartDate.UnixNano() {
+		return false
+	}
+
+	if !q.EndDate.IsZero() && timestamp > q.EndDate.UnixNano() {
+		return false
+	}
+
+	return true
+}
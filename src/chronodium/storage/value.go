@@ -0,0 +1,137 @@
+// Chronodium - Keeping Time in Series
+//
+// Copyright 2016-2017 Dolf Schimmel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"math"
+	"strconv"
+)
+
+// The numeric values of the types are part of the persisted encoding
+// and must not be changed.
+type ValueType uint8
+
+const (
+	FloatType   ValueType = 1
+	IntegerType ValueType = 2
+	BooleanType ValueType = 3
+	StringType  ValueType = 4
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case FloatType:
+		return "float"
+	case IntegerType:
+		return "integer"
+	case BooleanType:
+		return "boolean"
+	case StringType:
+		return "string"
+	}
+
+	return "unknown"
+}
+
+// Value holds a single value of any of the supported types
+type Value struct {
+	valueType ValueType
+	number    float64
+	integer   int64
+	str       string
+}
+
+func FloatValue(f float64) Value {
+	return Value{valueType: FloatType, number: f}
+}
+
+func IntegerValue(i int64) Value {
+	return Value{valueType: IntegerType, integer: i}
+}
+
+func BooleanValue(b bool) Value {
+	if b {
+		return Value{valueType: BooleanType, integer: 1}
+	}
+	return Value{valueType: BooleanType}
+}
+
+func StringValue(s string) Value {
+	return Value{valueType: StringType, str: s}
+}
+
+func (v Value) Type() ValueType {
+	return v.valueType
+}
+
+// IsNumeric reports whether the value can be aggregated. Booleans
+// are considered numeric, being either 0 or 1.
+func (v Value) IsNumeric() bool {
+	return v.valueType == FloatType || v.valueType == IntegerType || v.valueType == BooleanType
+}
+
+// Float returns the value as a float. Integers may lose precision,
+// strings return NaN.
+func (v Value) Float() float64 {
+	switch v.valueType {
+	case FloatType:
+		return v.number
+	case IntegerType, BooleanType:
+		return float64(v.integer)
+	}
+
+	return math.NaN()
+}
+
+// Integer returns integer and boolean values as is, floats are
+// truncated and strings return 0.
+func (v Value) Integer() int64 {
+	switch v.valueType {
+	case FloatType:
+		return int64(v.number)
+	case IntegerType, BooleanType:
+		return v.integer
+	}
+
+	return 0
+}
+
+func (v Value) Boolean() bool {
+	switch v.valueType {
+	case FloatType:
+		return v.number != 0
+	case IntegerType, BooleanType:
+		return v.integer != 0
+	case StringType:
+		return v.str != ""
+	}
+
+	return false
+}
+
+// String formats the value without loss of precision
+func (v Value) String() string {
+	switch v.valueType {
+	case FloatType:
+		return strconv.FormatFloat(v.number, 'f', -1, 64)
+	case IntegerType:
+		return strconv.FormatInt(v.integer, 10)
+	case BooleanType:
+		return strconv.FormatBool(v.integer != 0)
+	}
+
+	return v.str
+}
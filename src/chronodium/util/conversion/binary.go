@@ -15,20 +15,30 @@
 // limitations under the License.
 package conversion
 
-import "unsafe"
+import (
+	"encoding/binary"
+	"math"
+)
 
+// All conversions use little endian byte order, regardless of the byte
+// order of the host. Buffers must be at least 8 bytes long.
+
+// Float64ToBinary writes the IEEE 754 representation of f to buf
 func Float64ToBinary(buf []byte, f float64) {
-	valptr := uintptr(unsafe.Pointer(&f))
-	for i := 0; i < 8; i++ {
-		buf[i] = byte(*(*byte)(unsafe.Pointer(valptr)))
-		valptr++
-	}
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(f))
 }
 
+// Int64ToBinary writes the two's complement representation of v to buf
 func Int64ToBinary(buf []byte, v int64) {
-	valptr := uintptr(unsafe.Pointer(&v))
-	for i := 0; i < 8; i++ {
-		buf[i] = byte(*(*byte)(unsafe.Pointer(valptr)))
-		valptr++
-	}
+	binary.LittleEndian.PutUint64(buf, uint64(v))
+}
+
+// BinaryToFloat64 is the inverse of Float64ToBinary
+func BinaryToFloat64(buf []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+}
+
+// BinaryToInt64 is the inverse of Int64ToBinary
+func BinaryToInt64(buf []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(buf))
 }
@@ -54,6 +54,22 @@ func ParseDuration(str string) (time.Duration, error) {
 	return time.Duration(duration), nil
 }
 
+// Parse a timestamp given either in RFC3339 format or as a unix timestamp
+func ParseTime(timeString string) (time.Time, error) {
+	out, err := time.Parse(time.RFC3339, timeString)
+	if err == nil {
+		return out, nil
+	}
+
+	var timeInt int64
+	timeInt, err = strconv.ParseInt(timeString, 10, 64)
+	if err != nil {
+		return out, err
+	}
+
+	return time.Unix(timeInt, 0), nil
+}
+
 // See: http://stackoverflow.com/questions/28125963/golang-parse-time-duration
 // Licensed under cc by-sa 3.0 originally provided by Régis B.
 func ParseInt64(value string) int64 {